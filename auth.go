@@ -2,19 +2,272 @@
 
 package main
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
 
-func generateToken(secret string, streamId string) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": "stream_publish",
-		"sid": streamId,
-	})
+	"github.com/golang-jwt/jwt/v5"
+)
 
-	tokenb64, e := token.SignedString([]byte(secret))
+// Roles of the authentication tokens
+const (
+	AUTH_ROLE_PLAY    = "play"
+	AUTH_ROLE_PUBLISH = "publish"
+)
 
-	if e != nil {
-		return ""
+// Default expiration of the generated tokens
+const DEFAULT_TOKEN_EXPIRATION = 5 * time.Minute
+
+// Authentication options
+type AuthOptions struct {
+	lock sync.Mutex
+
+	secret *Secret // Secret to generate tokens (HS256)
+
+	signingKey        crypto.PrivateKey // Private key to generate tokens (RS256, ES256, EdDSA)
+	signingMethod     jwt.SigningMethod // Signing method for the private key
+	signingKeyFile    string            // File of the private key, loaded again when it changes
+	signingKeyModTime time.Time
+	signingKeySize    int64
+	keyId             string // Key ID (kid header)
+
+	sourceToken      *Secret // Fixed token for the source
+	destinationToken *Secret // Fixed token for the destination
+
+	provider *TokenProvider // External token provider
+
+	expiration time.Duration  // Expiration of the generated tokens (0 for no expiration)
+	notBefore  *time.Duration // Not-before of the generated tokens, relative to the generation time (nil to omit it)
+
+	claims map[string]interface{} // Additional claims
+}
+
+// Creates new authentication options
+func NewAuthOptions() *AuthOptions {
+	return &AuthOptions{
+		lock:             sync.Mutex{},
+		secret:           NewSecret(),
+		sourceToken:      NewSecret(),
+		destinationToken: NewSecret(),
+		expiration:       DEFAULT_TOKEN_EXPIRATION,
+		claims:           make(map[string]interface{}),
+	}
+}
+
+// Loads the secrets from environment variables
+// AUTH_SECRET, AUTH_SOURCE and AUTH_DESTINATION, or their _FILE variants
+// Called after parsing the command line, which takes precedence:
+// if a secret, signing key or token provider is set in the command line,
+// the environment variables are ignored, and a fixed token set in the command line
+// is not replaced.
+func (a *AuthOptions) loadFromEnv() error {
+	if a.secret.isSet() || a.signingKeyFile != "" || a.provider != nil {
+		return nil
+	}
+
+	err := a.secret.loadFromEnv("AUTH_SECRET")
+	if err != nil {
+		return err
+	}
+
+	if !a.sourceToken.isSet() {
+		err = a.sourceToken.loadFromEnv("AUTH_SOURCE")
+		if err != nil {
+			return err
+		}
+	}
+
+	if !a.destinationToken.isSet() {
+		err = a.destinationToken.loadFromEnv("AUTH_DESTINATION")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parses a custom claim (key=value)
+// The value is parsed as JSON if possible, or used as a string otherwise
+func (a *AuthOptions) addClaim(raw string) error {
+	eqIndex := strings.Index(raw, "=")
+
+	if eqIndex <= 0 {
+		return errors.New("expected <key>=<value>")
+	}
+
+	key := raw[:eqIndex]
+	rawValue := raw[eqIndex+1:]
+
+	var value interface{}
+
+	if json.Unmarshal([]byte(rawValue), &value) != nil {
+		value = rawValue
+	}
+
+	a.claims[key] = value
+
+	return nil
+}
+
+// Gets the token to authenticate a session
+// Called for every session, so generated tokens are always fresh
+// Returns an empty string if no authentication is configured
+func (a *AuthOptions) getToken(role string, streamId string) (string, error) {
+	if role == AUTH_ROLE_PLAY && a.sourceToken.isSet() {
+		return a.sourceToken.get()
+	}
+
+	if role == AUTH_ROLE_PUBLISH && a.destinationToken.isSet() {
+		return a.destinationToken.get()
+	}
+
+	if a.provider != nil {
+		return a.provider.getToken(role, streamId)
+	}
+
+	if !a.secret.isSet() && a.signingKeyFile == "" {
+		return "", nil
+	}
+
+	return a.generateToken(role, streamId)
+}
+
+// Generates a token for a role
+func (a *AuthOptions) generateToken(role string, streamId string) (string, error) {
+	now := time.Now()
+
+	claims := jwt.MapClaims{}
+
+	for key, value := range a.claims {
+		claims[key] = value
+	}
+
+	claims["sub"] = "stream_" + role
+	claims["sid"] = streamId
+	claims["iat"] = now.Unix()
+
+	if a.notBefore != nil {
+		claims["nbf"] = now.Add(*a.notBefore).Unix()
+	}
+
+	if a.expiration > 0 {
+		claims["exp"] = now.Add(a.expiration).Unix()
+	}
+
+	var method jwt.SigningMethod = jwt.SigningMethodHS256
+	var key interface{}
+
+	if a.signingKeyFile != "" {
+		a.lock.Lock()
+		err := a.reloadSigningKey()
+		method = a.signingMethod
+		key = a.signingKey
+		a.lock.Unlock()
+
+		if err != nil {
+			return "", err
+		}
+	} else {
+		secret, err := a.secret.get()
+		if err != nil {
+			return "", err
+		}
+		key = []byte(secret)
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+
+	if a.keyId != "" {
+		token.Header["kid"] = a.keyId
+	}
+
+	return token.SignedString(key)
+}
+
+// Sets the private key file (RSA, ECDSA or Ed25519) to sign tokens
+func (a *AuthOptions) setSigningKeyFile(file string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.signingKeyFile = file
+	a.signingKeyModTime = time.Time{}
+	a.signingKeySize = 0
+
+	return a.reloadSigningKey()
+}
+
+// Loads the private key file again, if it changed
+// Called with the lock held
+func (a *AuthOptions) reloadSigningKey() error {
+	pemBytes, modTime, size, changed, err := readFileIfChanged(a.signingKeyFile, a.signingKeyModTime, a.signingKeySize)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	err = a.loadSigningKey(pemBytes)
+	if err != nil {
+		return err
+	}
+
+	a.signingKeyModTime = modTime
+	a.signingKeySize = size
+
+	return nil
+}
+
+// Loads a private key (RSA, ECDSA or Ed25519) from PEM
+// The signing method is chosen from the key type
+func (a *AuthOptions) loadSigningKey(pemBytes []byte) error {
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); err == nil {
+		a.signingKey = rsaKey
+		a.signingMethod = jwt.SigningMethodRS256
+		return nil
+	}
+
+	if ecKey, err := jwt.ParseECPrivateKeyFromPEM(pemBytes); err == nil {
+		method, err := getECDSASigningMethod(ecKey)
+		if err != nil {
+			return err
+		}
+		a.signingKey = ecKey
+		a.signingMethod = method
+		return nil
 	}
 
-	return tokenb64
+	if edKey, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes); err == nil {
+		if _, ok := edKey.(ed25519.PrivateKey); !ok {
+			return errors.New("unsupported EdDSA key")
+		}
+		a.signingKey = edKey
+		a.signingMethod = jwt.SigningMethodEdDSA
+		return nil
+	}
+
+	return errors.New("not a valid RSA, ECDSA or Ed25519 private key")
+}
+
+// Gets the signing method for an ECDSA key, from its curve
+func getECDSASigningMethod(key *ecdsa.PrivateKey) (jwt.SigningMethod, error) {
+	switch key.Curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
+	default:
+		return nil, errors.New("unsupported ECDSA curve")
+	}
 }
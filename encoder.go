@@ -0,0 +1,202 @@
+// Encoder profile (WebRTC output)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	ENCODER_PRESET_LOW_LATENCY = "low-latency"
+	ENCODER_PRESET_BALANCED    = "balanced"
+	ENCODER_PRESET_QUALITY     = "quality"
+)
+
+const (
+	ENCODER_DEADLINE_REALTIME = "realtime"
+	ENCODER_DEADLINE_GOOD     = "good"
+	ENCODER_DEADLINE_BEST     = "best"
+)
+
+// Encoder profile
+// Zero values are not set
+type EncoderProfile struct {
+	bitrate          int    // Target bitrate (kbps)
+	maxBitrate       int    // Max bitrate (kbps)
+	crf              int    // Constant quality (4-63, lower is better)
+	gop              int    // Max distance between keyframes (frames)
+	keyframeInterval int    // Forced keyframe interval (seconds)
+	width            int    // Output width (-1 to keep aspect ratio)
+	height           int    // Output height (-1 to keep aspect ratio)
+	scaling          string // Scaling algorithm (bicubic, bilinear, lanczos...)
+	framerate        int    // Output framerate
+	threads          int    // Encoder threads
+	speed            int    // Encoder speed (cpu-used)
+	deadline         string // Encoder deadline (realtime, good, best)
+}
+
+// Default profile, used if no preset is set
+var DEFAULT_ENCODER_PROFILE = EncoderProfile{
+	speed:    5,
+	deadline: ENCODER_DEADLINE_REALTIME,
+	gop:      10,
+}
+
+// Named presets
+var ENCODER_PRESETS = map[string]EncoderProfile{
+	ENCODER_PRESET_LOW_LATENCY: {
+		bitrate:    1000,
+		maxBitrate: 1500,
+		gop:        10,
+		speed:      8,
+		deadline:   ENCODER_DEADLINE_REALTIME,
+	},
+	ENCODER_PRESET_BALANCED: {
+		bitrate:    2500,
+		maxBitrate: 4000,
+		gop:        30,
+		speed:      5,
+		deadline:   ENCODER_DEADLINE_REALTIME,
+	},
+	ENCODER_PRESET_QUALITY: {
+		bitrate:    5000,
+		maxBitrate: 8000,
+		crf:        10,
+		gop:        60,
+		speed:      3,
+		deadline:   ENCODER_DEADLINE_GOOD,
+	},
+}
+
+// Checks if the deadline is valid
+func isValidEncoderDeadline(deadline string) bool {
+	return deadline == ENCODER_DEADLINE_REALTIME || deadline == ENCODER_DEADLINE_GOOD || deadline == ENCODER_DEADLINE_BEST
+}
+
+// Builds the profile from a preset (or the default profile),
+// overriding the values set in the options
+func buildEncoderProfile(preset string, overrides EncoderProfile) (EncoderProfile, error) {
+	profile := DEFAULT_ENCODER_PROFILE
+
+	if preset != "" {
+		presetProfile, ok := ENCODER_PRESETS[preset]
+		if !ok {
+			return profile, errors.New("unknown preset: " + preset)
+		}
+		profile = presetProfile
+	}
+
+	if overrides.bitrate > 0 {
+		profile.bitrate = overrides.bitrate
+	}
+
+	if overrides.maxBitrate > 0 {
+		profile.maxBitrate = overrides.maxBitrate
+	}
+
+	if overrides.crf > 0 {
+		profile.crf = overrides.crf
+	}
+
+	if overrides.gop > 0 {
+		profile.gop = overrides.gop
+	}
+
+	if overrides.keyframeInterval > 0 {
+		profile.keyframeInterval = overrides.keyframeInterval
+	}
+
+	if overrides.width != 0 || overrides.height != 0 {
+		profile.width = overrides.width
+		profile.height = overrides.height
+	}
+
+	if overrides.scaling != "" {
+		profile.scaling = overrides.scaling
+	}
+
+	if overrides.framerate > 0 {
+		profile.framerate = overrides.framerate
+	}
+
+	if overrides.threads > 0 {
+		profile.threads = overrides.threads
+	}
+
+	if overrides.speed > 0 {
+		profile.speed = overrides.speed
+	}
+
+	if overrides.deadline != "" {
+		profile.deadline = overrides.deadline
+	}
+
+	if profile.crf > 0 && profile.bitrate == 0 {
+		return profile, errors.New("the constant quality mode requires a bitrate, used as the max bitrate")
+	}
+
+	if profile.maxBitrate > 0 && profile.bitrate > profile.maxBitrate {
+		return profile, errors.New("the bitrate cannot be greater than the max bitrate")
+	}
+
+	return profile, nil
+}
+
+// Returns the filter to scale the video and change the framerate
+func (p EncoderProfile) filter() string {
+	filters := make([]string, 0)
+
+	if p.framerate > 0 {
+		filters = append(filters, "fps="+fmt.Sprint(p.framerate))
+	}
+
+	if p.width != 0 || p.height != 0 {
+		scale := "scale=" + fmt.Sprint(p.width) + ":" + fmt.Sprint(p.height)
+
+		if p.scaling != "" {
+			scale += ":flags=" + p.scaling
+		}
+
+		filters = append(filters, scale)
+	}
+
+	return strings.Join(filters, ",")
+}
+
+// Appends the VP8 encoding options
+func (p EncoderProfile) appendArgs(args []string) []string {
+	args = append(args,
+		"-an",
+		"-vcodec", "libvpx",
+		"-cpu-used", fmt.Sprint(p.speed),
+		"-deadline", p.deadline,
+		"-g", fmt.Sprint(p.gop),
+	)
+
+	if p.keyframeInterval > 0 {
+		args = append(args, "-force_key_frames", "expr:gte(t,n_forced*"+fmt.Sprint(p.keyframeInterval)+")")
+	}
+
+	if p.bitrate > 0 {
+		args = append(args, "-b:v", fmt.Sprint(p.bitrate)+"k")
+	}
+
+	if p.maxBitrate > 0 {
+		args = append(args, "-maxrate", fmt.Sprint(p.maxBitrate)+"k", "-bufsize", fmt.Sprint(p.maxBitrate)+"k")
+	}
+
+	if p.crf > 0 {
+		args = append(args, "-crf", fmt.Sprint(p.crf))
+	}
+
+	if p.threads > 0 {
+		args = append(args, "-threads", fmt.Sprint(p.threads))
+	}
+
+	return append(args,
+		"-error-resilient", "1",
+		"-auto-alt-ref", "1",
+	)
+}
@@ -0,0 +1,129 @@
+// Stream endpoints
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	STREAM_PROTOCOL_WEBRTC_CDN = "webrtc-cdn"
+	STREAM_PROTOCOL_WHIP       = "whip"
+	STREAM_PROTOCOL_WHEP       = "whep"
+	STREAM_PROTOCOL_RTMP       = "rtmp"
+	STREAM_PROTOCOL_SRT        = "srt"
+	STREAM_PROTOCOL_NONE       = "none"
+)
+
+// Stream endpoint
+type StreamEndpoint struct {
+	protocol string  // Signaling protocol
+	url      url.URL // Node URL, without path (webrtc-cdn), endpoint URL (WHIP / WHEP) or media URL
+	streamId string  // Stream ID
+}
+
+// Returns a name for the endpoint, to be used in logs
+func (e StreamEndpoint) name() string {
+	if e.protocol == STREAM_PROTOCOL_NONE {
+		return "none"
+	}
+
+	if e.protocol != STREAM_PROTOCOL_WEBRTC_CDN {
+		return e.url.String()
+	}
+
+	return e.url.Host + "/" + e.streamId
+}
+
+// Checks if the endpoint uses WebRTC
+func (e StreamEndpoint) isWebRTC() bool {
+	switch e.protocol {
+	case STREAM_PROTOCOL_WEBRTC_CDN, STREAM_PROTOCOL_WHIP, STREAM_PROTOCOL_WHEP:
+		return true
+	default:
+		return false
+	}
+}
+
+// Parses a stream URL, like ws(s)://host:port/stream-id
+// The websocket path is not part of the URL, it is set by the websocket options (--ws-path)
+func parseStreamEndpoint(raw string) (StreamEndpoint, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return StreamEndpoint{}, err
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return StreamEndpoint{}, fmt.Errorf("not a valid websocket URL: %s", raw)
+	}
+
+	if len(u.Path) <= 1 {
+		return StreamEndpoint{}, fmt.Errorf("the URL must contain the stream ID. Example: ws://localhost/stream-id")
+	}
+
+	return StreamEndpoint{
+		protocol: STREAM_PROTOCOL_WEBRTC_CDN,
+		url: url.URL{
+			Scheme: u.Scheme,
+			Host:   u.Host,
+		},
+		streamId: u.Path[1:],
+	}, nil
+}
+
+// Parses a source URL
+// Can be a webrtc-cdn websocket URL or a WHEP endpoint URL
+func parseSourceEndpoint(raw string) (StreamEndpoint, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return StreamEndpoint{}, err
+	}
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return parseHTTPEndpoint(u, STREAM_PROTOCOL_WHEP), nil
+	}
+
+	return parseStreamEndpoint(raw)
+}
+
+// Parses a destination URL
+// Can be a webrtc-cdn websocket URL, a WHIP endpoint URL, a RTMP or SRT URL or "none"
+func parseDestinationEndpoint(raw string) (StreamEndpoint, error) {
+	if raw == "none" {
+		return StreamEndpoint{protocol: STREAM_PROTOCOL_NONE}, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return StreamEndpoint{}, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return parseHTTPEndpoint(u, STREAM_PROTOCOL_WHIP), nil
+	case "rtmp", "rtmps":
+		return StreamEndpoint{protocol: STREAM_PROTOCOL_RTMP, url: *u}, nil
+	case "srt":
+		return StreamEndpoint{protocol: STREAM_PROTOCOL_SRT, url: *u}, nil
+	}
+
+	return parseStreamEndpoint(raw)
+}
+
+// Parses the URL of an HTTP based endpoint
+// The stream ID is the last segment of the path
+func parseHTTPEndpoint(u *url.URL, protocol string) StreamEndpoint {
+	streamId := strings.TrimRight(u.Path, "/")
+
+	if slashIndex := strings.LastIndex(streamId, "/"); slashIndex >= 0 {
+		streamId = streamId[slashIndex+1:]
+	}
+
+	return StreamEndpoint{
+		protocol: protocol,
+		url:      *u,
+		streamId: streamId,
+	}
+}
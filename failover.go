@@ -0,0 +1,306 @@
+// Source failover
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const DEFAULT_SOURCE_TIMEOUT = 10 * time.Second
+const DEFAULT_FAILBACK_INTERVAL = 30 * time.Second
+
+const FAILOVER_CHECK_INTERVAL = time.Second
+
+// Session playing one of the sources
+type SourceSession struct {
+	lock sync.Mutex
+
+	source   StreamEndpoint
+	rewriter *RTPRewriter
+
+	active bool // True if the packets are forwarded to FFmpeg
+
+	started        time.Time
+	receivedPacket bool
+	lastPacket     time.Time
+
+	track *webrtc.TrackRemote // Video track being forwarded (the last one received)
+
+	closed    bool
+	closeFunc func()
+
+	retry bool // True if the session ended with a retryable error
+	fatal bool // True if the session ended with a fatal error
+
+	ended chan struct{} // Closed when the session ends
+}
+
+// Creates new source session
+func NewSourceSession(source StreamEndpoint, rewriter *RTPRewriter, active bool) *SourceSession {
+	return &SourceSession{
+		lock:     sync.Mutex{},
+		source:   source,
+		rewriter: rewriter,
+		active:   active,
+		started:  time.Now(),
+		ended:    make(chan struct{}),
+	}
+}
+
+// Sets the video track to forward, replacing the previous one (renegotiation)
+func (s *SourceSession) setTrack(track *webrtc.TrackRemote) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.track = track
+}
+
+// Checks if a track is the one being forwarded
+func (s *SourceSession) isCurrentTrack(track *webrtc.TrackRemote) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.track == track
+}
+
+// Checks if the session is active
+func (s *SourceSession) isActive() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.active
+}
+
+// Makes the session the active one
+func (s *SourceSession) activate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.active = true
+	s.rewriter.reset()
+}
+
+// Registers a received packet
+// Returns true if the packet must be forwarded
+func (s *SourceSession) onPacket() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.receivedPacket = true
+	s.lastPacket = time.Now()
+
+	return s.active
+}
+
+// Checks if the session received any packet
+func (s *SourceSession) hasReceivedPacket() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.receivedPacket
+}
+
+// Checks if the session stalled
+// (no packets received for the timeout duration)
+func (s *SourceSession) stalled(timeout time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.receivedPacket {
+		return time.Since(s.lastPacket) > timeout
+	} else {
+		return time.Since(s.started) > timeout
+	}
+}
+
+// Sets the function to call in order to close the session
+func (s *SourceSession) setCloseFunc(f func()) {
+	s.lock.Lock()
+	closed := s.closed
+	s.closeFunc = f
+	s.lock.Unlock()
+
+	if closed {
+		f()
+	}
+}
+
+// Closes the session
+func (s *SourceSession) close() {
+	s.lock.Lock()
+	s.closed = true
+	s.active = false
+	f := s.closeFunc
+	s.lock.Unlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+// Handles a signaling error of the session
+// Fatal errors (e.g. authentication) mark the source as failed, since reconnecting will not fix them
+// Retryable errors mark the session to be played again
+func (s *SourceSession) onSignalingError(err error) {
+	fmt.Println("[SOURCE] Error: " + err.Error())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if isFatalSignalingError(err) {
+		s.fatal = true
+	} else if isRetryableSignalingError(err) {
+		s.retry = true
+	}
+}
+
+// Checks if the session ended with a retryable error
+func (s *SourceSession) shouldRetry() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.retry
+}
+
+// Checks if the session ended with a fatal error
+func (s *SourceSession) isFatal() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.fatal
+}
+
+// Checks if the session has ended
+func (s *SourceSession) hasEnded() bool {
+	select {
+	case <-s.ended:
+		return true
+	default:
+		return false
+	}
+}
+
+// Plays the sources, switching to the next one if the active one
+// errors or stalls. Only returns if there is no way to continue.
+// Retryable errors are always retried, even with a single source and no slate.
+// Sources failing with fatal errors are skipped. If all of them fail, the process exits.
+func runSourceFailover(sources []StreamEndpoint, startPublish func(), options ProcessOptions) {
+	reconnect := options.slate.enabled() || len(sources) > 1
+
+	// Keeps the RTP stream sent to FFmpeg continuous between source sessions
+	rewriter := NewRTPRewriter(90000)
+
+	// Sources that failed with a fatal error
+	failed := make([]bool, len(sources))
+
+	index := 0
+
+	for {
+		session := NewSourceSession(sources[index], rewriter, true)
+		go runSourceSession(session, startPublish, options)
+
+		session, index = waitSourceSession(session, index, sources, failed, reconnect, startPublish, options)
+
+		if session.isFatal() {
+			fmt.Println("[SOURCE] Source failed: " + sources[index].name())
+			failed[index] = true
+		} else if !reconnect && !session.shouldRetry() {
+			return
+		}
+
+		next, ok := nextSource(index, failed)
+
+		if !ok {
+			fmt.Println("[SOURCE] Error: All the sources failed")
+			exitProcess(1)
+		}
+
+		if next <= index {
+			fmt.Println("[SOURCE] Reconnecting in " + fmt.Sprint(SOURCE_RECONNECT_DELAY.Seconds()) + " seconds...")
+			time.Sleep(SOURCE_RECONNECT_DELAY)
+		}
+
+		index = next
+
+		fmt.Println("[SOURCE] Switching to source: " + sources[index].name())
+	}
+}
+
+// Finds the next source to play after the given index, skipping the failed ones
+// Returns false if all the sources failed
+func nextSource(index int, failed []bool) (int, bool) {
+	for i := 1; i <= len(failed); i++ {
+		next := (index + i) % len(failed)
+
+		if !failed[next] {
+			return next, true
+		}
+	}
+
+	return 0, false
+}
+
+// Waits for the active session to end, probing the primary source for failback
+// If reconnect is true, stalled sessions are closed, so they can be played again
+// The primary source is not probed if it failed with a fatal error
+// Returns the session that was active when it ended (it changes on failback), and the index of its source
+func waitSourceSession(session *SourceSession, index int, sources []StreamEndpoint, failed []bool, reconnect bool, startPublish func(), options ProcessOptions) (*SourceSession, int) {
+	ticker := time.NewTicker(FAILOVER_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	var probe *SourceSession = nil
+	lastProbe := time.Now()
+
+	defer func() {
+		if probe != nil {
+			probe.close()
+		}
+	}()
+
+	for {
+		select {
+		case <-session.ended:
+			return session, index
+		case <-ticker.C:
+			if reconnect && session.stalled(options.sourceTimeout) {
+				fmt.Println("[SOURCE] Source stalled: " + session.source.name())
+				session.close()
+				<-session.ended
+				return session, index
+			}
+
+			if !options.failback || index == 0 || failed[0] {
+				continue
+			}
+
+			if probe == nil {
+				if time.Since(lastProbe) > options.failbackInterval {
+					// Check if the primary source is back
+					lastProbe = time.Now()
+					probe = NewSourceSession(sources[0], session.rewriter, false)
+					go runSourceSession(probe, startPublish, options)
+				}
+			} else if probe.hasReceivedPacket() {
+				// Primary source is back, fail back to it
+				fmt.Println("[SOURCE] Primary source is back. Switching to source: " + sources[0].name())
+				session.close()
+				probe.activate()
+				session = probe
+				index = 0
+				probe = nil
+			} else if probe.hasEnded() || probe.stalled(options.sourceTimeout) {
+				if probe.isFatal() {
+					fmt.Println("[SOURCE] Source failed: " + sources[0].name())
+					failed[0] = true
+				}
+
+				probe.close()
+				probe = nil
+			}
+		}
+	}
+}
@@ -4,46 +4,232 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 
 	child_process_manager "github.com/AgustinSRG/go-child-process-manager"
 )
 
-func runEncdingProcess(ffmpegBin string, source string, videoUDP string, videoFilter string, debug bool) {
-	args := make([]string, 1)
+// Encoder input
+type EncoderInput struct {
+	source string // SDP file, path to a video file or URL
+	sdp    bool   // True if the source is the SDP file of the forwarded track
+	live   bool   // True if the source is live (no pacing required)
+	loop   bool   // True to loop the source
+}
 
-	args[0] = ffmpegBin
+const (
+	ENCODER_OUTPUT_RTP   = "rtp"
+	ENCODER_OUTPUT_RTMP  = "rtmp"
+	ENCODER_OUTPUT_SRT   = "srt"
+	ENCODER_OUTPUT_HLS   = "hls"
+	ENCODER_OUTPUT_IMAGE = "image"
+	ENCODER_OUTPUT_RELAY = "relay"
+)
 
-	args = append(args, "-re")
+// Encoder output
+type EncoderOutput struct {
+	kind       string         // Output type
+	url        string         // Destination URL (or UDP address for RTP and relay, directory for HLS, file for images)
+	hls        HLSOptions     // HLS options
+	filter     string         // Additional filter for this output
+	unfiltered bool           // True to skip the video filter (source)
+	encoder    EncoderProfile // Encoder profile (WebRTC output)
+}
 
-	args = append(args, "-protocol_whitelist", "file,sdp,udp,rtp")
+// Parses an additional output URL (RTMP or SRT)
+func parseEncoderOutput(raw string) (EncoderOutput, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return EncoderOutput{}, err
+	}
 
-	// INPUT
-	args = append(args, "-i", source)
-
-	// VIDEO OPTIONS
-	args = append(args,
-		"-an",
-		"-vcodec", "libvpx",
-		"-cpu-used", "5",
-		"-deadline", "1",
-		"-g", "10",
-		"-error-resilient", "1",
-		"-auto-alt-ref", "1",
-	)
-
-	// VIDEO FILTER
-	if videoFilter != "" {
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp", "rtmps":
+		return EncoderOutput{kind: ENCODER_OUTPUT_RTMP, url: raw}, nil
+	case "srt":
+		return EncoderOutput{kind: ENCODER_OUTPUT_SRT, url: raw}, nil
+	default:
+		return EncoderOutput{}, fmt.Errorf("not a valid RTMP or SRT URL: %s", raw)
+	}
+}
+
+// Appends the encoding options and destination of an output
+func appendEncoderOutputArgs(args []string, output EncoderOutput) []string {
+	switch output.kind {
+	case ENCODER_OUTPUT_RTMP, ENCODER_OUTPUT_SRT, ENCODER_OUTPUT_RELAY:
+		args = append(args,
+			"-an",
+			"-vcodec", "libx264",
+			"-preset", "veryfast",
+			"-tune", "zerolatency",
+			"-pix_fmt", "yuv420p",
+			"-g", "50",
+		)
+	case ENCODER_OUTPUT_IMAGE:
+		args = append(args, "-an")
+	case ENCODER_OUTPUT_HLS:
+		// Keyframes aligned with the segments
 		args = append(args,
-			"-vf", videoFilter,
+			"-an",
+			"-vcodec", "libx264",
+			"-preset", "veryfast",
+			"-tune", "zerolatency",
+			"-pix_fmt", "yuv420p",
+			"-force_key_frames", "expr:gte(t,n_forced*"+fmt.Sprint(output.hls.segmentDuration)+")",
 		)
+	default:
+		args = output.encoder.appendArgs(args)
+	}
+
+	return args
+}
+
+// Appends the destination of an output
+func appendEncoderDestinationArgs(args []string, output EncoderOutput) []string {
+	switch output.kind {
+	case ENCODER_OUTPUT_RTMP:
+		return append(args, "-f", "flv", output.url)
+	case ENCODER_OUTPUT_SRT:
+		return append(args, "-f", "mpegts", output.url)
+	case ENCODER_OUTPUT_RELAY:
+		// MPEG-TS to the relay process (see output_relay.go)
+		return append(args, "-f", "mpegts", "udp://"+output.url+"?pkt_size=1316")
+	case ENCODER_OUTPUT_HLS:
+		return appendHLSDestinationArgs(args, output.hls)
+	case ENCODER_OUTPUT_IMAGE:
+		// Overwrite the same image
+		return append(args, "-f", "image2", "-update", "1", "-atomic_writing", "1", output.url)
+	default:
+		return append(args, "-f", "rtp", "rtp://"+output.url+"?pkt_size=1200")
+	}
+}
+
+// Joins filters into a filter chain
+func joinFilters(filters ...string) string {
+	chain := make([]string, 0)
+
+	for _, filter := range filters {
+		if filter != "" {
+			chain = append(chain, filter)
+		}
+	}
+
+	return strings.Join(chain, ",")
+}
+
+// Builds the filter graph for multiple outputs
+// The output streams are labeled [out0], [out1], ...
+func buildFilterGraph(outputs []EncoderOutput, videoFilter string) string {
+	filtered := make([]int, 0)
+	unfiltered := make([]int, 0)
+
+	for i, output := range outputs {
+		if output.unfiltered {
+			unfiltered = append(unfiltered, i)
+		} else {
+			filtered = append(filtered, i)
+		}
+	}
+
+	chains := make([]string, 0)
+
+	filteredInput := "[0:v]"
+	unfilteredInput := "[0:v]"
+
+	if len(filtered) > 0 && len(unfiltered) > 0 {
+		chains = append(chains, "[0:v]split=2[filtered][unfiltered]")
+		filteredInput = "[filtered]"
+		unfilteredInput = "[unfiltered]"
+	}
+
+	splitChain := func(input string, filter string, indexes []int) {
+		chain := input + joinFilters(filter, "split="+fmt.Sprint(len(indexes)))
+
+		for _, i := range indexes {
+			if outputs[i].filter != "" {
+				chain += "[split" + fmt.Sprint(i) + "]"
+			} else {
+				chain += "[out" + fmt.Sprint(i) + "]"
+			}
+		}
+
+		chains = append(chains, chain)
+	}
+
+	if len(filtered) > 0 {
+		splitChain(filteredInput, videoFilter, filtered)
+	}
+
+	if len(unfiltered) > 0 {
+		splitChain(unfilteredInput, "", unfiltered)
+	}
+
+	for i, output := range outputs {
+		if output.filter != "" {
+			chains = append(chains, "[split"+fmt.Sprint(i)+"]"+output.filter+"[out"+fmt.Sprint(i)+"]")
+		}
 	}
 
-	// VIDEO DESTINATION
-	args = append(args,
-		"-f", "rtp", "rtp://"+videoUDP+"?pkt_size=1200",
-	)
+	return strings.Join(chains, ";")
+}
+
+func runEncdingProcess(ffmpegBin string, input EncoderInput, outputs []EncoderOutput, videoFilter string, debug bool) {
+	args := make([]string, 1)
+
+	args[0] = ffmpegBin
+
+	// Report the progress to stdout
+	args = append(args, "-progress", "pipe:1")
+
+	if !input.live {
+		args = append(args, "-re")
+	}
+
+	if input.sdp {
+		args = append(args, "-protocol_whitelist", "file,sdp,udp,rtp")
+	}
+
+	if input.loop {
+		args = append(args, "-stream_loop", "-1")
+	}
+
+	// INPUT
+	args = append(args, "-i", input.source)
+
+	if len(outputs) == 1 && !outputs[0].unfiltered {
+		// VIDEO OPTIONS
+		args = appendEncoderOutputArgs(args, outputs[0])
+
+		// VIDEO FILTER
+		filter := joinFilters(videoFilter, outputs[0].filter)
+
+		if filter != "" {
+			args = append(args,
+				"-vf", filter,
+			)
+		}
+
+		// VIDEO DESTINATION
+		args = appendEncoderDestinationArgs(args, outputs[0])
+	} else {
+		// VIDEO FILTER
+		// The filter is applied once, and the result is split for each output
+		args = append(args, "-filter_complex", buildFilterGraph(outputs, videoFilter))
+
+		for i, output := range outputs {
+			args = append(args, "-map", "[out"+fmt.Sprint(i)+"]")
+
+			// VIDEO OPTIONS
+			args = appendEncoderOutputArgs(args, output)
+
+			// VIDEO DESTINATION
+			args = appendEncoderDestinationArgs(args, output)
+		}
+	}
 
 	cmd := exec.Command(ffmpegBin)
 	cmd.Args = args
@@ -55,21 +241,59 @@ func runEncdingProcess(ffmpegBin string, source string, videoUDP string, videoFi
 
 	child_process_manager.ConfigureCommand(cmd)
 
-	err := cmd.Start()
+	progressReader, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Println("Error: ffmpeg program failed: " + err.Error())
+		exitProcess(1)
+	}
+
+	err = cmd.Start()
 
 	if err != nil {
 		fmt.Println("Error: ffmpeg program failed: " + err.Error())
-		os.Exit(1)
+		exitProcess(1)
 	}
 
 	child_process_manager.AddChildProcess(cmd.Process)
 
+	progress := registerFFmpegProgress("encoder", debug)
+
+	progress.read(progressReader)
+
 	err = cmd.Wait()
 
+	progress.end()
+
 	if err != nil {
 		fmt.Println("Error: ffmpeg program failed: " + err.Error())
-		os.Exit(1)
+		exitProcess(1)
+	}
+
+	exitProcess(0)
+}
+
+// Parses a video size (WIDTHxHEIGHT), used by the encoder and thumbnail options
+// Width or height can be -1 to keep the aspect ratio
+func parseVideoSize(size string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(size), "x")
+
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width == 0 || width < -1 {
+		return 0, 0, fmt.Errorf("invalid width: %s", parts[0])
+	}
+
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height == 0 || height < -1 {
+		return 0, 0, fmt.Errorf("invalid height: %s", parts[1])
+	}
+
+	if width == -1 && height == -1 {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
 	}
 
-	os.Exit(0)
+	return width, height, nil
 }
@@ -32,7 +32,7 @@ func createForwardSDPFile(port int) string {
 	return fileName
 }
 
-func forwardTrack(track *webrtc.TrackRemote, port int) {
+func forwardTrack(track *webrtc.TrackRemote, port int, session *SourceSession, recorder *Recorder) {
 	// Create a local addr
 	var laddr *net.UDPAddr
 	var err error = nil
@@ -58,6 +58,11 @@ func forwardTrack(track *webrtc.TrackRemote, port int) {
 		}
 	}(conn)
 
+	// New track, keep the stream continuous for FFmpeg
+	if session.isActive() {
+		session.rewriter.reset()
+	}
+
 	b := make([]byte, 1500)
 	rtpPacket := &rtp.Packet{}
 	for {
@@ -67,11 +72,22 @@ func forwardTrack(track *webrtc.TrackRemote, port int) {
 			return
 		}
 
+		if !session.isCurrentTrack(track) {
+			return // Replaced by a new track
+		}
+
+		if !session.onPacket() {
+			continue // Not the active source
+		}
+
 		// Unmarshal the packet and update the PayloadType
 		if err = rtpPacket.Unmarshal(b[:n]); err != nil {
 			panic(err)
 		}
 		rtpPacket.PayloadType = 96
+		session.rewriter.rewrite(rtpPacket)
+
+		recorder.writeRTP(rtpPacket)
 
 		// Marshal into original buffer with updated PayloadType
 		if n, err = rtpPacket.MarshalTo(b); err != nil {
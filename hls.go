@@ -0,0 +1,122 @@
+// Local HLS / DASH output
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	HLS_MODE_HLS    = "hls"
+	HLS_MODE_LL_HLS = "ll-hls"
+	HLS_MODE_DASH   = "dash"
+)
+
+const DEFAULT_HLS_SEGMENT_DURATION = 2
+const DEFAULT_HLS_LIST_SIZE = 6
+
+// HLS / DASH output options
+type HLSOptions struct {
+	dir             string // Directory to write the segments
+	mode            string // HLS, LL-HLS or DASH
+	segmentDuration int    // Segment duration (seconds)
+	listSize        int    // Number of segments in the playlist
+}
+
+// Checks if the HLS output is enabled
+func (o HLSOptions) enabled() bool {
+	return o.dir != ""
+}
+
+// Checks if the mode is valid
+func isValidHLSMode(mode string) bool {
+	return mode == HLS_MODE_HLS || mode == HLS_MODE_LL_HLS || mode == HLS_MODE_DASH
+}
+
+// Returns the name of the playlist (or manifest) file
+func (o HLSOptions) playlistName() string {
+	switch o.mode {
+	case HLS_MODE_LL_HLS:
+		return "master.m3u8"
+	case HLS_MODE_DASH:
+		return "manifest.mpd"
+	default:
+		return "index.m3u8"
+	}
+}
+
+// Prepares the directory and returns the encoder output
+func (o HLSOptions) prepareOutput() (EncoderOutput, error) {
+	err := os.MkdirAll(o.dir, 0755)
+	if err != nil {
+		return EncoderOutput{}, err
+	}
+
+	return EncoderOutput{kind: ENCODER_OUTPUT_HLS, url: o.dir, hls: o}, nil
+}
+
+// Appends the destination of the HLS output
+func appendHLSDestinationArgs(args []string, o HLSOptions) []string {
+	segmentDuration := fmt.Sprint(o.segmentDuration)
+	listSize := fmt.Sprint(o.listSize)
+
+	switch o.mode {
+	case HLS_MODE_LL_HLS:
+		// The DASH muxer is able to generate low latency HLS playlists
+		return append(args,
+			"-f", "dash",
+			"-seg_duration", segmentDuration,
+			"-frag_type", "duration",
+			"-frag_duration", "0.5",
+			"-window_size", listSize,
+			"-extra_window_size", "2",
+			"-streaming", "1",
+			"-ldash", "1",
+			"-lhls", "1",
+			"-hls_playlist", "1",
+			"-use_template", "1",
+			"-use_timeline", "0",
+			"-remove_at_exit", "1",
+			filepath.Join(o.dir, "manifest.mpd"),
+		)
+	case HLS_MODE_DASH:
+		return append(args,
+			"-f", "dash",
+			"-seg_duration", segmentDuration,
+			"-window_size", listSize,
+			"-extra_window_size", "2",
+			"-use_template", "1",
+			"-use_timeline", "1",
+			"-remove_at_exit", "1",
+			filepath.Join(o.dir, "manifest.mpd"),
+		)
+	default:
+		return append(args,
+			"-f", "hls",
+			"-hls_time", segmentDuration,
+			"-hls_list_size", listSize,
+			"-hls_flags", "delete_segments+independent_segments",
+			"-hls_segment_filename", filepath.Join(o.dir, "segment_%05d.ts"),
+			filepath.Join(o.dir, "index.m3u8"),
+		)
+	}
+}
+
+// Registers the HTTP handler to serve the segments
+func registerHLSHandlers(o HLSOptions) {
+	fileServer := http.StripPrefix("/hls/", http.FileServer(http.Dir(o.dir)))
+
+	httpMux.HandleFunc("GET /hls/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if strings.HasSuffix(r.URL.Path, ".m3u8") || strings.HasSuffix(r.URL.Path, ".mpd") {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
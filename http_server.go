@@ -0,0 +1,25 @@
+// Built-in HTTP server
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const DEFAULT_HTTP_ADDR = "127.0.0.1:8080"
+
+// Handlers of the built-in HTTP server
+var httpMux = http.NewServeMux()
+
+// Runs the built-in HTTP server
+func runHTTPServer(addr string) {
+	fmt.Println("[HTTP] Listening on " + addr)
+
+	err := http.ListenAndServe(addr, httpMux)
+
+	if err != nil {
+		fmt.Println("Error: HTTP server failed: " + err.Error())
+		exitProcess(1)
+	}
+}
@@ -0,0 +1,282 @@
+// HTTP based signaling (WHIP / WHEP)
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const HTTP_SIGNALING_TIMEOUT = 10 * time.Second
+
+// HTTP based signaling session
+// The offer is sent with a POST request to the endpoint, creating a resource
+// Candidates are sent with PATCH requests (trickle ICE), and the resource is deleted on close
+type HTTPSignalingSession struct {
+	lock sync.Mutex
+
+	endpoint  url.URL
+	authToken string
+	logPrefix string
+	debug     bool
+
+	client *http.Client
+
+	resource *url.URL
+	etag     string
+
+	iceUfrag   string
+	icePwd     string
+	mediaLine  string
+	mid        string
+	candidates []string
+
+	trickleDisabled bool
+	closed          bool
+}
+
+// Creates new HTTP signaling session
+func NewHTTPSignalingSession(endpoint url.URL, authToken string, logPrefix string, debug bool) *HTTPSignalingSession {
+	return &HTTPSignalingSession{
+		lock:       sync.Mutex{},
+		endpoint:   endpoint,
+		authToken:  authToken,
+		logPrefix:  logPrefix,
+		debug:      debug,
+		client:     &http.Client{Timeout: HTTP_SIGNALING_TIMEOUT},
+		candidates: make([]string, 0),
+	}
+}
+
+func (s *HTTPSignalingSession) newRequest(method string, u string, contentType string, body string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+
+	return req, nil
+}
+
+// Sends the SDP offer to the endpoint
+// Returns the SDP answer
+// Request failures are returned as signaling errors
+func (s *HTTPSignalingSession) offer(offer string) (string, error) {
+	s.lock.Lock()
+	s.readLocalDescription(offer)
+	s.lock.Unlock()
+
+	req, err := s.newRequest("POST", s.endpoint.String(), "application/sdp", offer)
+	if err != nil {
+		return "", err
+	}
+
+	if s.debug {
+		fmt.Println(s.logPrefix + " POST " + s.endpoint.String() + "\n" + offer)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", &SignalingError{message: err.Error(), retryable: true}
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", &SignalingError{message: err.Error(), retryable: true}
+	}
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		// Authentication errors are not retryable
+		return "", &SignalingError{
+			message:   fmt.Sprintf("unexpected status code %d: %s", res.StatusCode, string(body)),
+			retryable: res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden,
+		}
+	}
+
+	if s.debug {
+		fmt.Println(s.logPrefix + " Response:\n" + string(body))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	location := res.Header.Get("Location")
+	if location != "" {
+		locationURL, err := url.Parse(location)
+		if err != nil {
+			return "", err
+		}
+		s.resource = s.endpoint.ResolveReference(locationURL)
+	} else {
+		s.trickleDisabled = true // No resource to send the candidates
+	}
+
+	s.etag = res.Header.Get("ETag")
+
+	if len(s.candidates) > 0 {
+		candidates := s.candidates
+		s.candidates = make([]string, 0)
+		go s.sendCandidates(candidates)
+	}
+
+	return string(body), nil
+}
+
+// Reads the ICE credentials and the first media section from the local description
+func (s *HTTPSignalingSession) readLocalDescription(sdp string) {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if strings.HasPrefix(line, "a=ice-ufrag:") && s.iceUfrag == "" {
+			s.iceUfrag = line[len("a=ice-ufrag:"):]
+		} else if strings.HasPrefix(line, "a=ice-pwd:") && s.icePwd == "" {
+			s.icePwd = line[len("a=ice-pwd:"):]
+		} else if strings.HasPrefix(line, "m=") && s.mediaLine == "" {
+			s.mediaLine = line
+		} else if strings.HasPrefix(line, "a=mid:") && s.mid == "" {
+			s.mid = line[len("a=mid:"):]
+		}
+	}
+}
+
+// Handles a local ICE candidate
+// Nil means end of candidates
+func (s *HTTPSignalingSession) onLocalCandidate(i *webrtc.ICECandidate) {
+	candidate := "a=end-of-candidates"
+
+	if i != nil {
+		candidate = "a=" + i.ToJSON().Candidate
+	}
+
+	s.lock.Lock()
+
+	if s.trickleDisabled || s.closed {
+		s.lock.Unlock()
+		return
+	}
+
+	if s.resource == nil {
+		// Wait for the resource to be created
+		s.candidates = append(s.candidates, candidate)
+		s.lock.Unlock()
+		return
+	}
+
+	s.lock.Unlock()
+
+	s.sendCandidates([]string{candidate})
+}
+
+// Sends candidates to the resource (trickle ICE)
+func (s *HTTPSignalingSession) sendCandidates(candidates []string) {
+	s.lock.Lock()
+
+	if s.trickleDisabled || s.closed || s.resource == nil {
+		s.lock.Unlock()
+		return
+	}
+
+	nl := "\r\n"
+
+	fragment := "a=ice-ufrag:" + s.iceUfrag + nl +
+		"a=ice-pwd:" + s.icePwd + nl
+
+	if s.mediaLine != "" {
+		fragment += s.mediaLine + nl
+	}
+
+	if s.mid != "" {
+		fragment += "a=mid:" + s.mid + nl
+	}
+
+	for _, candidate := range candidates {
+		fragment += candidate + nl
+	}
+
+	resource := s.resource.String()
+	etag := s.etag
+
+	s.lock.Unlock()
+
+	req, err := s.newRequest("PATCH", resource, "application/trickle-ice-sdpfrag", fragment)
+	if err != nil {
+		fmt.Println(s.logPrefix + " Error: " + err.Error())
+		return
+	}
+
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	if s.debug {
+		fmt.Println(s.logPrefix + " PATCH " + resource + "\n" + fragment)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		fmt.Println(s.logPrefix + " Error: " + err.Error())
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented {
+		// The server does not support trickle ICE
+		s.lock.Lock()
+		s.trickleDisabled = true
+		s.lock.Unlock()
+		return
+	}
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		fmt.Println(s.logPrefix + " Error: Could not send ICE candidates. Status code: " + fmt.Sprint(res.StatusCode))
+	}
+}
+
+// Closes the session, deleting the resource
+func (s *HTTPSignalingSession) close() {
+	s.lock.Lock()
+
+	if s.closed || s.resource == nil {
+		s.closed = true
+		s.lock.Unlock()
+		return
+	}
+
+	s.closed = true
+	resource := s.resource.String()
+
+	s.lock.Unlock()
+
+	req, err := s.newRequest("DELETE", resource, "", "")
+	if err != nil {
+		fmt.Println(s.logPrefix + " Error: " + err.Error())
+		return
+	}
+
+	if s.debug {
+		fmt.Println(s.logPrefix + " DELETE " + resource)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		fmt.Println(s.logPrefix + " Error: " + err.Error())
+		return
+	}
+	res.Body.Close()
+}
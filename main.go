@@ -4,9 +4,10 @@ package main
 
 import (
 	"fmt"
-	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	child_process_manager "github.com/AgustinSRG/go-child-process-manager"
 )
@@ -34,59 +35,60 @@ func main() {
 		return
 	}
 
-	source := args[len(args)-2]
+	mediaSource := ""
+	sources := make([]StreamEndpoint, 0)
 
-	uSource, err := url.Parse(source)
-	if err != nil || (uSource.Scheme != "ws" && uSource.Scheme != "wss") {
-		fmt.Println("The source is not a valid websocket URL")
-		return
-	}
-
-	destination := args[len(args)-1]
-
-	uDest, err := url.Parse(destination)
-	if err != nil || (uDest.Scheme != "ws" && uDest.Scheme != "wss") {
-		fmt.Println("The destination is not a valid websocket URL")
-		return
-	}
-
-	protocolSource := uSource.Scheme
-	hostSource := uSource.Host
-	streamIdSource := ""
-
-	if len(uSource.Path) > 0 {
-		streamIdSource = uSource.Path[1:]
+	if isMediaSource(args[len(args)-2]) {
+		mediaSource = args[len(args)-2]
 	} else {
-		fmt.Println("The source URL must contain the stream ID. Example: ws://localhost/stream-id")
-	}
-
-	wsURLSource := url.URL{
-		Scheme: protocolSource,
-		Host:   hostSource,
-		Path:   "/ws",
-	}
-
-	protocolDest := uDest.Scheme
-	hostDest := uDest.Host
-	streamIdDest := ""
-
-	if len(uDest.Path) > 0 {
-		streamIdDest = uDest.Path[1:]
-	} else {
-		fmt.Println("The destination URL must contain the stream ID. Example: ws://localhost/stream-id")
+		if err := checkSourceFile(args[len(args)-2]); err != nil {
+			fmt.Println("The source is not valid: " + err.Error())
+			return
+		}
+		source, err := parseSourceEndpoint(args[len(args)-2])
+		if err != nil {
+			fmt.Println("The source is not valid: " + err.Error())
+			return
+		}
+		sources = append(sources, source)
 	}
 
-	wsURLDest := url.URL{
-		Scheme: protocolDest,
-		Host:   hostDest,
-		Path:   "/ws",
+	destination, err := parseDestinationEndpoint(args[len(args)-1])
+	if err != nil {
+		fmt.Println("The destination is not valid: " + err.Error())
+		return
 	}
 
 	debug := false
 	videoFilter := ""
-	authTokenSource := ""
-	authTokenDest := ""
+	auth := NewAuthOptions()
 	port := 4000
+	sourceTimeout := DEFAULT_SOURCE_TIMEOUT
+	signalingTimeout := DEFAULT_SIGNALING_TIMEOUT
+	wsOptions := NewWebsocketOptions()
+	encoderPreset := ""
+	encoderOverrides := EncoderProfile{}
+	failback := false
+	failbackInterval := DEFAULT_FAILBACK_INTERVAL
+	loop := false
+	httpAddr := ""
+	preview := false
+	outputs := make([]EncoderOutput, 0)
+	recording := RecordingOptions{}
+	thumbnails := ThumbnailOptions{
+		interval: DEFAULT_THUMBNAIL_INTERVAL,
+		format:   DEFAULT_THUMBNAIL_FORMAT,
+		width:    DEFAULT_THUMBNAIL_WIDTH,
+		height:   -1,
+	}
+	hls := HLSOptions{
+		mode:            HLS_MODE_HLS,
+		segmentDuration: DEFAULT_HLS_SEGMENT_DURATION,
+		listSize:        DEFAULT_HLS_LIST_SIZE,
+	}
+	slate := SlateOptions{
+		timeout: DEFAULT_SLATE_TIMEOUT,
+	}
 
 	for i := 1; i < (len(args) - 2); i++ {
 		arg := args[i]
@@ -112,14 +114,36 @@ func main() {
 				fmt.Println("The option '--auth-source' requires a value")
 				return
 			}
-			authTokenSource = args[i+1]
+			auth.sourceToken.set(args[i+1])
 			i++
 		} else if arg == "--auth-destination" || arg == "-ad" {
 			if i == len(args)-3 {
 				fmt.Println("The option '--auth-destination' requires a value")
 				return
 			}
-			authTokenDest = args[i+1]
+			auth.destinationToken.set(args[i+1])
+			i++
+		} else if arg == "--auth-source-file" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--auth-source-file' requires a value")
+				return
+			}
+			err := auth.sourceToken.setFile(args[i+1])
+			if err != nil {
+				fmt.Println("Error: Could not read the file: " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--auth-destination-file" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--auth-destination-file' requires a value")
+				return
+			}
+			err := auth.destinationToken.setFile(args[i+1])
+			if err != nil {
+				fmt.Println("Error: Could not read the file: " + err.Error())
+				return
+			}
 			i++
 		} else if arg == "--port" || arg == "-p" {
 			if i == len(args)-3 {
@@ -137,12 +161,584 @@ func main() {
 				fmt.Println("The option '--secret' requires a value")
 				return
 			}
-			authTokenSource = generateToken(args[i+1], streamIdSource)
-			authTokenDest = generateToken(args[i+1], streamIdDest)
+			auth.secret.set(args[i+1])
+			i++
+		} else if arg == "--secret-file" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--secret-file' requires a value")
+				return
+			}
+			err := auth.secret.setFile(args[i+1])
+			if err != nil {
+				fmt.Println("Error: Could not read the file: " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--signing-key" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--signing-key' requires a value")
+				return
+			}
+			err := auth.setSigningKeyFile(args[i+1])
+			if err != nil {
+				fmt.Println("Error: Could not load the signing key: " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--signing-key-id" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--signing-key-id' requires a value")
+				return
+			}
+			auth.keyId = args[i+1]
+			i++
+		} else if arg == "--token-provider-url" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--token-provider-url' requires a value")
+				return
+			}
+			auth.provider = NewHTTPTokenProvider(args[i+1])
+			i++
+		} else if arg == "--token-provider-command" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--token-provider-command' requires a value")
+				return
+			}
+			auth.provider = NewCommandTokenProvider(args[i+1])
+			i++
+		} else if arg == "--token-expiration" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--token-expiration' requires a value")
+				return
+			}
+			expirationSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil || expirationSeconds < 0 {
+				fmt.Println("The option '--token-expiration' requires a numeric value")
+				return
+			}
+			auth.expiration = time.Duration(expirationSeconds) * time.Second
+			i++
+		} else if arg == "--token-not-before" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--token-not-before' requires a value")
+				return
+			}
+			notBeforeSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				fmt.Println("The option '--token-not-before' requires a numeric value")
+				return
+			}
+			notBefore := time.Duration(notBeforeSeconds) * time.Second
+			auth.notBefore = &notBefore
+			i++
+		} else if arg == "--token-claim" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--token-claim' requires a value")
+				return
+			}
+			err := auth.addClaim(args[i+1])
+			if err != nil {
+				fmt.Println("The option '--token-claim' is not valid: " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--slate-image" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--slate-image' requires a value")
+				return
+			}
+			slate.image = args[i+1]
+			i++
+		} else if arg == "--slate-video" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--slate-video' requires a value")
+				return
+			}
+			slate.video = args[i+1]
+			i++
+		} else if arg == "--slate-text" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--slate-text' requires a value")
+				return
+			}
+			slate.text = args[i+1]
+			i++
+		} else if arg == "--slate-timeout" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--slate-timeout' requires a value")
+				return
+			}
+			slateTimeout, err := strconv.Atoi(args[i+1])
+			if err != nil || slateTimeout <= 0 {
+				fmt.Println("The option '--slate-timeout' requires a numeric value")
+				return
+			}
+			slate.timeout = time.Duration(slateTimeout) * time.Second
+			i++
+		} else if arg == "--fallback-source" || arg == "-fs" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--fallback-source' requires a value")
+				return
+			}
+			fallbackSource, err := parseSourceEndpoint(args[i+1])
+			if err != nil {
+				fmt.Println("The fallback source is not valid: " + err.Error())
+				return
+			}
+			sources = append(sources, fallbackSource)
+			i++
+		} else if arg == "--source-timeout" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--source-timeout' requires a value")
+				return
+			}
+			timeoutSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil || timeoutSeconds <= 0 {
+				fmt.Println("The option '--source-timeout' requires a numeric value")
+				return
+			}
+			sourceTimeout = time.Duration(timeoutSeconds) * time.Second
+			i++
+		} else if arg == "--signaling-timeout" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--signaling-timeout' requires a value")
+				return
+			}
+			timeoutSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil || timeoutSeconds <= 0 {
+				fmt.Println("The option '--signaling-timeout' requires a numeric value")
+				return
+			}
+			signalingTimeout = time.Duration(timeoutSeconds) * time.Second
+			i++
+		} else if arg == "--ws-path" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-path' requires a value")
+				return
+			}
+			wsOptions.path = "/" + strings.TrimLeft(args[i+1], "/")
+			i++
+		} else if arg == "--ws-ca" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-ca' requires a value")
+				return
+			}
+			wsOptions.caFile = args[i+1]
+			i++
+		} else if arg == "--ws-cert" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-cert' requires a value")
+				return
+			}
+			wsOptions.certFile = args[i+1]
+			i++
+		} else if arg == "--ws-key" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-key' requires a value")
+				return
+			}
+			wsOptions.keyFile = args[i+1]
+			i++
+		} else if arg == "--ws-insecure" {
+			wsOptions.insecure = true
+		} else if arg == "--ws-proxy" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-proxy' requires a value")
+				return
+			}
+			wsOptions.proxy = args[i+1]
+			i++
+		} else if arg == "--ws-header" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-header' requires a value")
+				return
+			}
+			err := wsOptions.addHeader(args[i+1])
+			if err != nil {
+				fmt.Println("Invalid value for '--ws-header': " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--ws-origin" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-origin' requires a value")
+				return
+			}
+			wsOptions.headers.Set("Origin", args[i+1])
+			i++
+		} else if arg == "--ws-dial-timeout" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--ws-dial-timeout' requires a value")
+				return
+			}
+			timeoutSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil || timeoutSeconds <= 0 {
+				fmt.Println("The option '--ws-dial-timeout' requires a numeric value")
+				return
+			}
+			wsOptions.dialTimeout = time.Duration(timeoutSeconds) * time.Second
+			i++
+		} else if arg == "--encoder-preset" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-preset' requires a value")
+				return
+			}
+			if _, ok := ENCODER_PRESETS[args[i+1]]; !ok {
+				fmt.Println("The option '--encoder-preset' must be one of: low-latency, balanced, quality")
+				return
+			}
+			encoderPreset = args[i+1]
+			i++
+		} else if arg == "--encoder-bitrate" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-bitrate' requires a value")
+				return
+			}
+			encoderOverrides.bitrate, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.bitrate <= 0 {
+				fmt.Println("The option '--encoder-bitrate' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--encoder-max-bitrate" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-max-bitrate' requires a value")
+				return
+			}
+			encoderOverrides.maxBitrate, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.maxBitrate <= 0 {
+				fmt.Println("The option '--encoder-max-bitrate' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--encoder-crf" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-crf' requires a value")
+				return
+			}
+			encoderOverrides.crf, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.crf < 4 || encoderOverrides.crf > 63 {
+				fmt.Println("The option '--encoder-crf' requires a numeric value between 4 and 63")
+				return
+			}
+			i++
+		} else if arg == "--encoder-gop" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-gop' requires a value")
+				return
+			}
+			encoderOverrides.gop, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.gop <= 0 {
+				fmt.Println("The option '--encoder-gop' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--encoder-keyframe-interval" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-keyframe-interval' requires a value")
+				return
+			}
+			encoderOverrides.keyframeInterval, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.keyframeInterval <= 0 {
+				fmt.Println("The option '--encoder-keyframe-interval' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--encoder-size" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-size' requires a value")
+				return
+			}
+			encoderOverrides.width, encoderOverrides.height, err = parseVideoSize(args[i+1])
+			if err != nil {
+				fmt.Println("The option '--encoder-size' requires a value like WIDTHxHEIGHT: " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--encoder-scaling" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-scaling' requires a value")
+				return
+			}
+			encoderOverrides.scaling = args[i+1]
+			i++
+		} else if arg == "--encoder-framerate" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-framerate' requires a value")
+				return
+			}
+			encoderOverrides.framerate, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.framerate <= 0 {
+				fmt.Println("The option '--encoder-framerate' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--encoder-threads" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-threads' requires a value")
+				return
+			}
+			encoderOverrides.threads, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.threads <= 0 {
+				fmt.Println("The option '--encoder-threads' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--encoder-speed" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-speed' requires a value")
+				return
+			}
+			encoderOverrides.speed, err = strconv.Atoi(args[i+1])
+			if err != nil || encoderOverrides.speed < 1 || encoderOverrides.speed > 16 {
+				fmt.Println("The option '--encoder-speed' requires a numeric value between 1 and 16")
+				return
+			}
+			i++
+		} else if arg == "--encoder-deadline" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--encoder-deadline' requires a value")
+				return
+			}
+			if !isValidEncoderDeadline(args[i+1]) {
+				fmt.Println("The option '--encoder-deadline' must be one of: realtime, good, best")
+				return
+			}
+			encoderOverrides.deadline = args[i+1]
+			i++
+		} else if arg == "--loop" {
+			loop = true
+		} else if arg == "--http-addr" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--http-addr' requires a value")
+				return
+			}
+			httpAddr = args[i+1]
+			i++
+		} else if arg == "--output" || arg == "-o" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--output' requires a value")
+				return
+			}
+			output, err := parseEncoderOutput(args[i+1])
+			if err != nil {
+				fmt.Println("The output is not valid: " + err.Error())
+				return
+			}
+			outputs = append(outputs, output)
+			i++
+		} else if arg == "--hls" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--hls' requires a value")
+				return
+			}
+			hls.dir = args[i+1]
+			i++
+		} else if arg == "--hls-mode" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--hls-mode' requires a value")
+				return
+			}
+			if !isValidHLSMode(args[i+1]) {
+				fmt.Println("The option '--hls-mode' must be one of: hls, ll-hls, dash")
+				return
+			}
+			hls.mode = args[i+1]
+			i++
+		} else if arg == "--hls-segment-duration" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--hls-segment-duration' requires a value")
+				return
+			}
+			hls.segmentDuration, err = strconv.Atoi(args[i+1])
+			if err != nil || hls.segmentDuration <= 0 {
+				fmt.Println("The option '--hls-segment-duration' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--hls-list-size" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--hls-list-size' requires a value")
+				return
+			}
+			hls.listSize, err = strconv.Atoi(args[i+1])
+			if err != nil || hls.listSize <= 0 {
+				fmt.Println("The option '--hls-list-size' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--record-source" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--record-source' requires a value")
+				return
+			}
+			recording.sourceTemplate = args[i+1]
+			i++
+		} else if arg == "--record-output" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--record-output' requires a value")
+				return
+			}
+			recording.outputTemplate = args[i+1]
+			i++
+		} else if arg == "--record-segment-duration" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--record-segment-duration' requires a value")
+				return
+			}
+			segmentSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil || segmentSeconds <= 0 {
+				fmt.Println("The option '--record-segment-duration' requires a numeric value")
+				return
+			}
+			recording.segmentDuration = time.Duration(segmentSeconds) * time.Second
+			i++
+		} else if arg == "--record-segment-size" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--record-segment-size' requires a value")
+				return
+			}
+			segmentMegabytes, err := strconv.Atoi(args[i+1])
+			if err != nil || segmentMegabytes <= 0 {
+				fmt.Println("The option '--record-segment-size' requires a numeric value")
+				return
+			}
+			recording.segmentSize = int64(segmentMegabytes) * 1024 * 1024
+			i++
+		} else if arg == "--thumbnails" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--thumbnails' requires a value")
+				return
+			}
+			thumbnails.dir = args[i+1]
+			i++
+		} else if arg == "--thumbnail-interval" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--thumbnail-interval' requires a value")
+				return
+			}
+			thumbnails.interval, err = strconv.Atoi(args[i+1])
+			if err != nil || thumbnails.interval <= 0 {
+				fmt.Println("The option '--thumbnail-interval' requires a numeric value")
+				return
+			}
+			i++
+		} else if arg == "--thumbnail-format" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--thumbnail-format' requires a value")
+				return
+			}
+			if !isValidThumbnailFormat(args[i+1]) {
+				fmt.Println("The option '--thumbnail-format' must be one of: jpg, png, webp")
+				return
+			}
+			thumbnails.format = args[i+1]
+			i++
+		} else if arg == "--thumbnail-size" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--thumbnail-size' requires a value")
+				return
+			}
+			thumbnails.width, thumbnails.height, err = parseVideoSize(args[i+1])
+			if err != nil {
+				fmt.Println("The option '--thumbnail-size' requires a value like WIDTHxHEIGHT: " + err.Error())
+				return
+			}
+			i++
+		} else if arg == "--thumbnail-source" {
+			thumbnails.source = true
+		} else if arg == "--preview" {
+			preview = true
+		} else if arg == "--failback" {
+			failback = true
+		} else if arg == "--failback-interval" {
+			if i == len(args)-3 {
+				fmt.Println("The option '--failback-interval' requires a value")
+				return
+			}
+			intervalSeconds, err := strconv.Atoi(args[i+1])
+			if err != nil || intervalSeconds <= 0 {
+				fmt.Println("The option '--failback-interval' requires a numeric value")
+				return
+			}
+			failbackInterval = time.Duration(intervalSeconds) * time.Second
 			i++
 		}
 	}
 
+	err = auth.loadFromEnv()
+	if err != nil {
+		fmt.Println("Error: Could not load the authentication secrets: " + err.Error())
+		return
+	}
+
+	if auth.secret.isSet() && auth.signingKeyFile != "" {
+		fmt.Println("The options '--secret' and '--signing-key' cannot be used together")
+		return
+	}
+
+	if auth.provider != nil && (auth.secret.isSet() || auth.signingKeyFile != "") {
+		fmt.Println("A token provider cannot be used together with '--secret' or '--signing-key'")
+		return
+	}
+
+	if mediaSource != "" && len(sources) > 0 {
+		fmt.Println("Fallback sources are only supported for websocket sources")
+		return
+	}
+
+	err = validateWebRTCConfig()
+	if err != nil {
+		fmt.Println("Error: Invalid WebRTC configuration: " + err.Error())
+		os.Exit(1)
+	}
+
+	err = createICEMuxes()
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		os.Exit(1)
+	}
+
+	encoder, err := buildEncoderProfile(encoderPreset, encoderOverrides)
+	if err != nil {
+		fmt.Println("Error: Invalid encoder options: " + err.Error())
+		return
+	}
+
+	err = wsOptions.prepare()
+	if err != nil {
+		fmt.Println("Error: Invalid websocket options: " + err.Error())
+		return
+	}
+
+	if hls.enabled() {
+		hlsOutput, err := hls.prepareOutput()
+		if err != nil {
+			fmt.Println("Error: Could not prepare the HLS directory: " + err.Error())
+			return
+		}
+		outputs = append(outputs, hlsOutput)
+	}
+
+	if thumbnails.enabled() {
+		thumbnailOutputs, err := thumbnails.prepareOutputs()
+		if err != nil {
+			fmt.Println("Error: Could not prepare the thumbnails directory: " + err.Error())
+			return
+		}
+		outputs = append(outputs, thumbnailOutputs...)
+	}
+
+	if recording.sourceTemplate != "" && mediaSource != "" {
+		fmt.Println("The source can only be recorded if it is a WebRTC source")
+		return
+	}
+
+	if destination.protocol == STREAM_PROTOCOL_NONE && !preview && len(outputs) == 0 && recording.outputTemplate == "" {
+		fmt.Println("No destination and no additional outputs. Use --preview to preview the filtered stream.")
+		return
+	}
+
 	if _, err := os.Stat(ffmpegPath); err != nil {
 		fmt.Println("Error: Could not find 'ffmpeg' at specified location: " + ffmpegPath)
 		return
@@ -155,20 +751,80 @@ func main() {
 	}
 	defer child_process_manager.DisposeChildProcessManager()
 
-	runProcess(wsURLSource, streamIdSource, wsURLDest, streamIdDest, ProcessOptions{
-		debug:                debug,
-		port:                 port,
-		ffmpeg:               ffmpegPath,
-		videoFilter:          videoFilter,
-		authTokenSource:      authTokenSource,
-		authTokenDestination: authTokenDest,
-	})
+	handleShutdownSignals()
+
+	if (preview || hls.enabled() || thumbnails.enabled()) && httpAddr == "" {
+		httpAddr = DEFAULT_HTTP_ADDR
+	}
+
+	var previewServer *PreviewServer = nil
+
+	if preview {
+		previewServer = NewPreviewServer(debug)
+	}
+
+	if hls.enabled() {
+		registerHLSHandlers(hls)
+		fmt.Println("[HLS] Playlist available at: http://" + httpAddr + "/hls/" + hls.playlistName())
+	}
+
+	if thumbnails.enabled() {
+		registerThumbnailHandlers(thumbnails)
+		fmt.Println("[THUMBNAILS] Thumbnail available at: http://" + httpAddr + "/thumbnails/" + thumbnails.fileName("output"))
+	}
+
+	if httpAddr != "" {
+		registerStatusHandlers()
+		go runHTTPServer(httpAddr)
+	}
+
+	var sourceRecorder *Recorder = nil
+
+	if recording.sourceTemplate != "" {
+		sourceRecorder = NewRecorder("source", recording.sourceTemplate, sources[0].streamId, recording)
+	}
+
+	var outputRecorder *Recorder = nil
+
+	if recording.outputTemplate != "" {
+		outputStreamId := destination.streamId
+		if outputStreamId == "" {
+			outputStreamId = "output"
+		}
+		outputRecorder = NewRecorder("output", recording.outputTemplate, outputStreamId, recording)
+	}
+
+	processOptions := ProcessOptions{
+		debug:            debug,
+		port:             port,
+		ffmpeg:           ffmpegPath,
+		videoFilter:      videoFilter,
+		slate:            slate,
+		sourceTimeout:    sourceTimeout,
+		signalingTimeout: signalingTimeout,
+		auth:             auth,
+		websocket:        wsOptions,
+		encoder:          encoder,
+		failback:         failback,
+		failbackInterval: failbackInterval,
+		loop:             loop,
+		preview:          previewServer,
+		outputs:          outputs,
+		sourceRecorder:   sourceRecorder,
+		outputRecorder:   outputRecorder,
+	}
+
+	if mediaSource != "" {
+		runMediaSourceProcess(mediaSource, destination, processOptions)
+	} else {
+		runProcess(sources, destination, processOptions)
+	}
 }
 
 func printHelp() {
 	fmt.Println("Usage: webrtc-video-filter [OPTIONS] <SOURCE> <DESTINATION>")
-	fmt.Println("    SOURCE: Can be a path to a video file or RTMP URL")
-	fmt.Println("    DESTINATION: Websocket URL like ws(s)://host:port/stream-id")
+	fmt.Println("    SOURCE: Websocket URL like ws(s)://host:port/stream-id, WHEP endpoint URL, path to a video file or RTMP, SRT or HTTP(S) media URL")
+	fmt.Println("    DESTINATION: Websocket URL like ws(s)://host:port/stream-id, WHIP endpoint URL like http(s)://host:port/whip/stream-id, RTMP or SRT URL or 'none'")
 	fmt.Println("    OPTIONS:")
 	fmt.Println("        --help, -h                              Prints command line options.")
 	fmt.Println("        --version, -v                           Prints version.")
@@ -178,13 +834,66 @@ func printHelp() {
 	fmt.Println("        --ffmpeg-path <path>                    Sets FFMpeg path.")
 	fmt.Println("        --auth-source, -as <auth-token>         Sets authentication token for the source.")
 	fmt.Println("        --auth-destination, -ad <auth-token>    Sets authentication token for the destination.")
+	fmt.Println("        --auth-source-file <path>               Reads the authentication token for the source from a file.")
+	fmt.Println("        --auth-destination-file <path>          Reads the authentication token for the destination from a file.")
 	fmt.Println("        --secret, -s <secret>                   Sets secret to generate authentication tokens.")
+	fmt.Println("        --secret-file <path>                    Reads the secret to generate authentication tokens from a file.")
+	fmt.Println("        --signing-key <pem-file>                Sets a private key (RSA, ECDSA or Ed25519) to generate authentication tokens.")
+	fmt.Println("        --signing-key-id <kid>                  Sets the key ID (kid header) of the generated tokens.")
+	fmt.Println("        --token-provider-url <url>              Gets the authentication tokens from an HTTP endpoint.")
+	fmt.Println("        --token-provider-command <command>      Gets the authentication tokens by running a local command (split on whitespace, no quoting).")
+	fmt.Println("        --token-expiration <seconds>            Sets the expiration of the generated tokens. Use 0 for no expiration (By default 300).")
+	fmt.Println("        --token-not-before <seconds>            Sets the not-before of the generated tokens, relative to the current time (By default not set).")
+	fmt.Println("        --token-claim <key>=<value>             Adds a custom claim to the generated tokens. Can be used multiple times.")
+	fmt.Println("        --slate-image <path>                    Sets an image to show while the source is down.")
+	fmt.Println("        --slate-video <path>                    Sets a video clip to loop while the source is down.")
+	fmt.Println("        --slate-text <text>                     Sets a text to show while the source is down.")
+	fmt.Println("        --slate-timeout <seconds>               Sets the time without video to switch to the slate (By default 3).")
+	fmt.Println("        --fallback-source, -fs <url>            Adds a fallback source, used if the previous ones fail.")
+	fmt.Println("        --source-timeout <seconds>              Sets the time without video to switch to the next source (By default 10).")
+	fmt.Println("        --failback                              Switches back to the primary source when it returns.")
+	fmt.Println("        --failback-interval <seconds>           Sets the interval to check the primary source (By default 30).")
+	fmt.Println("        --signaling-timeout <seconds>           Sets the time to wait for the signaling server to respond (By default 30).")
+	fmt.Println("        --encoder-preset <preset>               Sets the encoder preset: low-latency, balanced or quality.")
+	fmt.Println("        --encoder-bitrate <kbps>                Sets the target bitrate of the WebRTC output.")
+	fmt.Println("        --encoder-max-bitrate <kbps>            Sets the max bitrate of the WebRTC output.")
+	fmt.Println("        --encoder-crf <4-63>                    Sets the constant quality of the WebRTC output (lower is better).")
+	fmt.Println("        --encoder-gop <frames>                  Sets the max distance between keyframes (By default 10).")
+	fmt.Println("        --encoder-keyframe-interval <seconds>   Forces a keyframe every interval.")
+	fmt.Println("        --encoder-size <width>x<height>         Sets the output resolution. Use -1 to keep aspect ratio.")
+	fmt.Println("        --encoder-scaling <algorithm>           Sets the scaling algorithm: bicubic, bilinear, lanczos...")
+	fmt.Println("        --encoder-framerate <fps>               Sets the output framerate.")
+	fmt.Println("        --encoder-threads <count>               Sets the number of encoder threads.")
+	fmt.Println("        --encoder-speed <1-16>                  Sets the encoder speed, higher is faster (By default 5).")
+	fmt.Println("        --encoder-deadline <deadline>           Sets the encoder deadline: realtime, good or best (By default realtime).")
+	fmt.Println("        --ws-path <path>                        Sets the path of the websocket endpoint of the webrtc-cdn nodes (By default /ws).")
+	fmt.Println("        --ws-ca <pem-file>                      Sets a CA bundle to verify the webrtc-cdn nodes (wss).")
+	fmt.Println("        --ws-cert <pem-file>                    Sets a client certificate for the webrtc-cdn nodes (wss).")
+	fmt.Println("        --ws-key <pem-file>                     Sets the key of the client certificate.")
+	fmt.Println("        --ws-insecure                           Skips the TLS verification of the webrtc-cdn nodes.")
+	fmt.Println("        --ws-proxy <url>                        Connects to the webrtc-cdn nodes through an HTTP or SOCKS5 proxy.")
+	fmt.Println("        --ws-header '<name>: <value>'           Adds a header to the websocket requests. Can be used multiple times.")
+	fmt.Println("        --ws-origin <origin>                    Sets the Origin header of the websocket requests.")
+	fmt.Println("        --ws-dial-timeout <seconds>             Sets the time to connect to the webrtc-cdn nodes (By default 10).")
+	fmt.Println("        --loop                                  Loops the source, if it is a video file.")
+	fmt.Println("        --http-addr <addr>                      Sets the address of the built-in HTTP server (By default 127.0.0.1:8080).")
+	fmt.Println("        --preview                               Enables the local WHEP preview of the filtered stream.")
+	fmt.Println("        --output, -o <url>                      Adds an additional RTMP or SRT output for the filtered stream.")
+	fmt.Println("        --record-source <template>              Records the source to WebM / MKV files.")
+	fmt.Println("        --record-output <template>              Records the filtered stream to WebM / MKV files.")
+	fmt.Println("        --record-segment-duration <seconds>     Sets the max duration of each recording file.")
+	fmt.Println("        --record-segment-size <MB>              Sets the max size of each recording file.")
+	fmt.Println("        --thumbnails <dir>                      Writes thumbnails of the filtered stream to a directory.")
+	fmt.Println("        --thumbnail-interval <seconds>          Sets the interval between thumbnails (By default 10).")
+	fmt.Println("        --thumbnail-format <format>             Sets the thumbnail format: jpg, png or webp (By default jpg).")
+	fmt.Println("        --thumbnail-size <width>x<height>       Sets the thumbnail size. Use -1 to keep aspect ratio (By default 320x-1).")
+	fmt.Println("        --thumbnail-source                      Also writes thumbnails of the unfiltered source.")
+	fmt.Println("        --hls <dir>                             Writes the filtered stream as HLS segments to a directory.")
+	fmt.Println("        --hls-mode <mode>                       Sets the HLS mode: hls, ll-hls or dash (By default hls).")
+	fmt.Println("        --hls-segment-duration <seconds>        Sets the HLS segment duration (By default 2).")
+	fmt.Println("        --hls-list-size <count>                 Sets the number of segments in the HLS playlist (By default 6).")
 }
 
 func printVersion() {
 	fmt.Println("webrtc-video-filter 1.0.0")
 }
-
-func killProcess() {
-	os.Exit(0)
-}
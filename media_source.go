@@ -0,0 +1,94 @@
+// Media source (video file, RTMP, SRT or HTTP)
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// File extensions of media that can be read from HTTP URLs
+// Other HTTP URLs are considered WHEP endpoints
+var HTTP_MEDIA_EXTENSIONS = []string{
+	".mp4", ".m4v", ".mov", ".mkv", ".webm", ".flv", ".avi", ".ts", ".m3u8", ".mpd",
+}
+
+// Checks if the source is a video file or a media URL
+// that FFmpeg can read directly
+func isMediaSource(source string) bool {
+	u, err := url.Parse(source)
+
+	if err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "ws", "wss":
+			return false
+		case "rtmp", "rtmps", "srt":
+			return true
+		case "http", "https":
+			ext := strings.ToLower(path.Ext(u.Path))
+			for _, mediaExt := range HTTP_MEDIA_EXTENSIONS {
+				if ext == mediaExt {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	info, err := os.Stat(source)
+
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Checks a source that is not a URL, expected to be a video file
+// Returns nil for URLs
+func checkSourceFile(source string) error {
+	if strings.Contains(source, "://") {
+		return nil
+	}
+
+	info, err := os.Stat(source)
+
+	if os.IsNotExist(err) {
+		return errors.New("file not found: " + source)
+	} else if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file: " + source)
+	}
+
+	return nil
+}
+
+// Creates the encoder input for a media source
+func getMediaSourceInput(source string, loop bool) EncoderInput {
+	live := false
+
+	u, err := url.Parse(source)
+
+	if err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "rtmp", "rtmps", "srt":
+			live = true
+		}
+	}
+
+	return EncoderInput{
+		source: source,
+		live:   live,
+		loop:   loop,
+	}
+}
+
+// Runs the process with a media source
+// The WebRTC source is skipped, feeding the media directly to FFmpeg
+func runMediaSourceProcess(source string, destination StreamEndpoint, options ProcessOptions) {
+	runPublish(getMediaSourceInput(source, options.loop), destination, options.publishOptions())
+
+	killProcess()
+}
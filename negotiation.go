@@ -0,0 +1,201 @@
+// Negotiation of the webrtc-cdn peer connections (offers, re-offers and ICE restarts)
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Time in disconnected state before requesting an ICE restart
+const ICE_RESTART_DELAY = 3 * time.Second
+
+// Negotiates a peer connection through a signaling request
+// The server sends the offers. An offer is only sent by us to restart ICE.
+type SignalingNegotiator struct {
+	lock sync.Mutex
+
+	peerConnection *webrtc.PeerConnection
+	req            *SignalingRequest
+
+	logPrefix string
+
+	disconnectedAt time.Time // Time of the last disconnection (zero if connected)
+
+	// Remote candidates received before the remote description
+	pendingCandidates []webrtc.ICECandidateInit
+}
+
+// Creates new negotiator
+// The candidates received by the request before the offer are queued
+func NewSignalingNegotiator(peerConnection *webrtc.PeerConnection, req *SignalingRequest, logPrefix string) *SignalingNegotiator {
+	n := &SignalingNegotiator{
+		lock:              sync.Mutex{},
+		peerConnection:    peerConnection,
+		req:               req,
+		logPrefix:         logPrefix,
+		pendingCandidates: make([]webrtc.ICECandidateInit, 0),
+	}
+
+	for _, candidate := range req.takeEarlyCandidates() {
+		n.pendingCandidates = append(n.pendingCandidates, candidateInit(candidate))
+	}
+
+	return n
+}
+
+// Gets the candidate to add to the peer connection
+// End of candidates is an empty candidate
+func candidateInit(candidate SignalingCandidate) webrtc.ICECandidateInit {
+	if candidate.candidate == nil {
+		return webrtc.ICECandidateInit{Candidate: ""}
+	}
+
+	return *candidate.candidate
+}
+
+// Handles a remote candidate
+// Candidates received before the remote description are queued
+func (n *SignalingNegotiator) onCandidate(candidate SignalingCandidate) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	init := candidateInit(candidate)
+
+	if n.peerConnection.RemoteDescription() == nil {
+		n.pendingCandidates = append(n.pendingCandidates, init)
+		return nil
+	}
+
+	return n.peerConnection.AddICECandidate(init)
+}
+
+// Adds the queued candidates, once the remote description is set
+// Called with the lock held
+func (n *SignalingNegotiator) flushCandidates() {
+	for _, candidate := range n.pendingCandidates {
+		err := n.peerConnection.AddICECandidate(candidate)
+		if err != nil {
+			fmt.Println(n.logPrefix + " Error: " + err.Error())
+		}
+	}
+
+	n.pendingCandidates = n.pendingCandidates[:0]
+}
+
+// Sets an offer received from the server as the remote description
+// If we sent an offer (ICE restart) at the same time, ours is rolled back
+func (n *SignalingNegotiator) setRemoteOffer(offer webrtc.SessionDescription) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.peerConnection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		err := n.peerConnection.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := n.peerConnection.SetRemoteDescription(offer)
+	if err != nil {
+		return err
+	}
+
+	n.flushCandidates()
+
+	return nil
+}
+
+// Creates the answer for the current remote offer and sends it
+func (n *SignalingNegotiator) answer() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	answer, err := n.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+
+	err = n.peerConnection.SetLocalDescription(answer)
+	if err != nil {
+		return err
+	}
+
+	return n.req.sendAnswer(answer)
+}
+
+// Handles an offer received from the server (initial offer or renegotiation)
+func (n *SignalingNegotiator) onOffer(offer webrtc.SessionDescription) error {
+	err := n.setRemoteOffer(offer)
+	if err != nil {
+		return err
+	}
+
+	return n.answer()
+}
+
+// Handles an answer received from the server to our ICE restart offer
+func (n *SignalingNegotiator) onAnswer(answer webrtc.SessionDescription) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return nil // Offer rolled back
+	}
+
+	return n.peerConnection.SetRemoteDescription(answer)
+}
+
+// Handles a connection state change
+// If the connection stays disconnected, ICE is restarted
+func (n *SignalingNegotiator) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if state != webrtc.PeerConnectionStateDisconnected {
+		n.disconnectedAt = time.Time{}
+		return
+	}
+
+	disconnectedAt := time.Now()
+	n.disconnectedAt = disconnectedAt
+
+	time.AfterFunc(ICE_RESTART_DELAY, func() {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+
+		if n.disconnectedAt != disconnectedAt {
+			return // Reconnected, or disconnected again later
+		}
+
+		err := n.restartIce()
+		if err != nil {
+			fmt.Println(n.logPrefix + " Error: ICE restart failed: " + err.Error())
+		}
+	})
+}
+
+// Sends an offer to restart ICE
+// Called with the lock held
+func (n *SignalingNegotiator) restartIce() error {
+	if n.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		return nil // Negotiation in progress
+	}
+
+	fmt.Println(n.logPrefix + " WebRTC: Restarting ICE...")
+
+	offer, err := n.peerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+
+	err = n.peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+
+	return n.req.sendOffer(offer)
+}
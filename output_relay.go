@@ -0,0 +1,163 @@
+// Additional outputs relay
+// The additional RTMP / SRT outputs are encoded by the main FFmpeg process,
+// and sent to a separate FFmpeg process for each output, so a failing ingest
+// does not stop the main process. The relay processes are restarted if they fail.
+// The main process sends the stream to a local UDP socket, owned by this process
+// for its whole lifetime, and the packets are piped to the input of the relay process.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	child_process_manager "github.com/AgustinSRG/go-child-process-manager"
+)
+
+// Delay to restart a relay process after it fails
+const OUTPUT_RELAY_RETRY_DELAY = 5 * time.Second
+
+// Size of the read buffer of the relay UDP sockets
+const OUTPUT_RELAY_READ_BUFFER_SIZE = 1000000
+
+// Relay of an additional output
+type OutputRelay struct {
+	lock sync.Mutex
+
+	ffmpegBin string
+	output    EncoderOutput
+	debug     bool
+
+	listener *net.UDPConn
+
+	stdin io.WriteCloser // Input of the running relay process (nil if not running)
+}
+
+// Replaces the additional RTMP / SRT outputs with relay outputs,
+// starting the relay processes
+func startOutputRelays(ffmpegBin string, outputs []EncoderOutput, debug bool) []EncoderOutput {
+	result := make([]EncoderOutput, 0, len(outputs))
+
+	for _, output := range outputs {
+		if output.kind != ENCODER_OUTPUT_RTMP && output.kind != ENCODER_OUTPUT_SRT {
+			result = append(result, output)
+			continue
+		}
+
+		listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			fmt.Println("Error: Could not open the UDP listener for the output relay: " + err.Error())
+			exitProcess(1)
+		}
+
+		listener.SetReadBuffer(OUTPUT_RELAY_READ_BUFFER_SIZE)
+
+		relay := &OutputRelay{
+			lock:      sync.Mutex{},
+			ffmpegBin: ffmpegBin,
+			output:    output,
+			debug:     debug,
+			listener:  listener,
+		}
+
+		go relay.readLoop()
+		go relay.run()
+
+		result = append(result, EncoderOutput{kind: ENCODER_OUTPUT_RELAY, url: listener.LocalAddr().String(), filter: output.filter, unfiltered: output.unfiltered})
+	}
+
+	return result
+}
+
+// Reads the packets sent by the main process, piping them to the relay process
+// The packets are dropped while the relay process is not running
+func (r *OutputRelay) readLoop() {
+	buf := make([]byte, 2048)
+
+	for {
+		n, _, err := r.listener.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Println("[OUTPUT] Error: " + r.output.url + ": " + err.Error())
+			return
+		}
+
+		r.lock.Lock()
+		stdin := r.stdin
+		r.lock.Unlock()
+
+		if stdin != nil {
+			stdin.Write(buf[:n]) // Fails if the process ended, it is restarted by run()
+		}
+	}
+}
+
+// Runs the relay process, restarting it if it fails
+func (r *OutputRelay) run() {
+	for {
+		err := r.runProcess()
+
+		if err != nil {
+			fmt.Println("[OUTPUT] Error: " + r.output.url + ": " + err.Error())
+		} else {
+			fmt.Println("[OUTPUT] Output ended: " + r.output.url)
+		}
+
+		fmt.Println("[OUTPUT] Restarting " + r.output.url + " in " + fmt.Sprint(OUTPUT_RELAY_RETRY_DELAY) + "...")
+		time.Sleep(OUTPUT_RELAY_RETRY_DELAY)
+	}
+}
+
+// Runs the relay process, copying the encoded stream to the destination
+func (r *OutputRelay) runProcess() error {
+	args := make([]string, 1)
+
+	args[0] = r.ffmpegBin
+
+	// INPUT (MPEG-TS from the main process, piped to stdin)
+	args = append(args, "-f", "mpegts", "-i", "pipe:0")
+
+	// VIDEO OPTIONS (already encoded)
+	args = append(args, "-an", "-c:v", "copy")
+
+	// VIDEO DESTINATION
+	args = appendEncoderDestinationArgs(args, r.output)
+
+	cmd := exec.Command(r.ffmpegBin)
+	cmd.Args = args
+
+	if r.debug {
+		cmd.Stderr = os.Stderr
+		fmt.Println("Running command: " + cmd.String())
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	child_process_manager.ConfigureCommand(cmd)
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	child_process_manager.AddChildProcess(cmd.Process)
+
+	r.lock.Lock()
+	r.stdin = stdin
+	r.lock.Unlock()
+
+	err = cmd.Wait()
+
+	r.lock.Lock()
+	r.stdin = nil
+	r.lock.Unlock()
+
+	return err
+}
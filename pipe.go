@@ -8,10 +8,11 @@ import (
 	"io"
 	"net"
 
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
-func pipeTrack(listener *net.UDPConn, track *webrtc.TrackLocalStaticRTP) {
+func pipeTrack(listener *net.UDPConn, switcher *TrackSwitcher, input int) {
 	inboundRTPPacket := make([]byte, 1600) // UDP MTU
 	for {
 		n, _, err := listener.ReadFrom(inboundRTPPacket)
@@ -19,7 +20,12 @@ func pipeTrack(listener *net.UDPConn, track *webrtc.TrackLocalStaticRTP) {
 			panic(fmt.Sprintf("error during read: %s", err))
 		}
 
-		if _, err = track.Write(inboundRTPPacket[:n]); err != nil {
+		packet := &rtp.Packet{}
+		if err = packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
+			continue // Invalid packet
+		}
+
+		if err = switcher.write(input, packet); err != nil {
 			if errors.Is(err, io.ErrClosedPipe) {
 				// The peerConnection has been closed.
 				return
@@ -0,0 +1,278 @@
+// Local WHEP preview of the filtered output
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// WHEP server for the local preview
+type PreviewServer struct {
+	lock sync.Mutex
+
+	debug bool
+
+	track *webrtc.TrackLocalStaticRTP
+
+	sessions map[string]*webrtc.PeerConnection
+}
+
+// Creates the preview server, registering the HTTP handlers
+func NewPreviewServer(debug bool) *PreviewServer {
+	p := &PreviewServer{
+		lock:     sync.Mutex{},
+		debug:    debug,
+		track:    nil,
+		sessions: make(map[string]*webrtc.PeerConnection),
+	}
+
+	httpMux.HandleFunc("GET /preview", p.handlePlayer)
+	httpMux.HandleFunc("POST /preview/whep", p.handleOffer)
+	httpMux.HandleFunc("PATCH /preview/whep/{id}", p.handleCandidates)
+	httpMux.HandleFunc("DELETE /preview/whep/{id}", p.handleDelete)
+
+	return p
+}
+
+// Sets the filtered track to preview
+func (p *PreviewServer) setTrack(track *webrtc.TrackLocalStaticRTP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.track = track
+}
+
+func (p *PreviewServer) removeSession(id string) {
+	p.lock.Lock()
+	peerConnection := p.sessions[id]
+	delete(p.sessions, id)
+	p.lock.Unlock()
+
+	if peerConnection != nil {
+		peerConnection.Close()
+	}
+}
+
+func generateSessionId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Handles the WHEP offer (POST)
+func (p *PreviewServer) handleOffer(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	track := p.track
+	p.lock.Unlock()
+
+	if track == nil {
+		http.Error(w, "The filtered track is not available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	offer, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Create peer connection
+	peerConnectionConfig := loadWebRTCConfig(WEBRTC_LEG_PREVIEW) // Load config
+	peerConnection, err := createWebRTCAPI(WEBRTC_LEG_PREVIEW).NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	videoSender, err := peerConnection.AddTrack(track)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go readPacketsFromRTPSender(videoSender)
+
+	id := generateSessionId()
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			if p.debug {
+				fmt.Println("[PREVIEW] WebRTC: Disconnected: " + id)
+			}
+			p.removeSession(id)
+		} else if state == webrtc.PeerConnectionStateConnected {
+			if p.debug {
+				fmt.Println("[PREVIEW] WebRTC: Connected: " + id)
+			}
+		}
+	})
+
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	})
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Include the candidates in the answer
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	err = peerConnection.SetLocalDescription(answer)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	<-gatherComplete
+
+	p.lock.Lock()
+	p.sessions[id] = peerConnection
+	p.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/preview/whep/"+id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(peerConnection.LocalDescription().SDP))
+}
+
+// Handles remote candidates (PATCH)
+func (p *PreviewServer) handleCandidates(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	peerConnection := p.sessions[r.PathValue("id")]
+	p.lock.Unlock()
+
+	if peerConnection == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	fragment, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, line := range strings.Split(string(fragment), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+
+		err = peerConnection.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate: line[len("a="):],
+		})
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles the session deletion (DELETE)
+func (p *PreviewServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	p.removeSession(r.PathValue("id"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Serves the player page
+func (p *PreviewServer) handlePlayer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(PREVIEW_PLAYER_HTML))
+}
+
+const PREVIEW_PLAYER_HTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>webrtc-video-filter preview</title>
+<style>
+body { margin: 0; background: #000; color: #fff; font-family: sans-serif; }
+video { width: 100vw; height: 100vh; object-fit: contain; }
+#status { position: fixed; top: 8px; left: 8px; font-size: 14px; }
+</style>
+</head>
+<body>
+<div id="status">Connecting...</div>
+<video id="video" autoplay muted playsinline controls></video>
+<script>
+(async function () {
+	const status = document.getElementById("status");
+	const pc = new RTCPeerConnection();
+	let resource = null;
+
+	pc.addTransceiver("video", { direction: "recvonly" });
+
+	pc.ontrack = function (ev) {
+		document.getElementById("video").srcObject = ev.streams[0] || new MediaStream([ev.track]);
+	};
+
+	pc.onconnectionstatechange = function () {
+		status.innerText = pc.connectionState;
+	};
+
+	const offer = await pc.createOffer();
+	await pc.setLocalDescription(offer);
+
+	await new Promise(function (resolve) {
+		if (pc.iceGatheringState === "complete") {
+			return resolve();
+		}
+		pc.onicegatheringstatechange = function () {
+			if (pc.iceGatheringState === "complete") {
+				resolve();
+			}
+		};
+	});
+
+	const res = await fetch("/preview/whep", {
+		method: "POST",
+		headers: { "Content-Type": "application/sdp" },
+		body: pc.localDescription.sdp,
+	});
+
+	if (res.status !== 201) {
+		status.innerText = "Error: " + (await res.text());
+		return;
+	}
+
+	resource = res.headers.get("Location");
+
+	await pc.setRemoteDescription({ type: "answer", sdp: await res.text() });
+
+	window.addEventListener("beforeunload", function () {
+		if (resource) {
+			fetch(resource, { method: "DELETE", keepalive: true });
+		}
+	});
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,336 @@
+// FFmpeg progress and health reporting
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encoding speed below this value is considered slower than realtime
+const FFMPEG_SLOW_SPEED_THRESHOLD = 0.95
+
+// Time the speed must stay below the threshold to flag the process as slow
+const FFMPEG_SLOW_DELAY = 5 * time.Second
+
+// Interval to log a progress summary
+const FFMPEG_PROGRESS_LOG_INTERVAL = time.Minute
+
+// Interval to log a progress summary (debug mode)
+const FFMPEG_PROGRESS_DEBUG_LOG_INTERVAL = 10 * time.Second
+
+// Progress of an FFmpeg process
+type FFmpegProgress struct {
+	lock sync.Mutex
+
+	name  string
+	debug bool
+
+	running bool
+
+	frame       int64
+	fps         float64
+	bitrate     float64 // kbps
+	speed       float64 // 1 = realtime
+	dropFrames  int64
+	dupFrames   int64
+	outTime     time.Duration
+	updatedAt   time.Time
+	startedAt   time.Time
+	lastLogAt   time.Time
+	slow        bool
+	slowSince   time.Time // Time the speed went below the threshold (zero if not below)
+	slowReports int64     // Number of times the process was flagged as slow
+}
+
+// Status of an FFmpeg process (JSON)
+type FFmpegProgressStatus struct {
+	Name        string  `json:"name"`
+	Running     bool    `json:"running"`
+	Frame       int64   `json:"frame"`
+	FPS         float64 `json:"fps"`
+	Bitrate     float64 `json:"bitrate_kbps"`
+	Speed       float64 `json:"speed"`
+	DropFrames  int64   `json:"drop_frames"`
+	DupFrames   int64   `json:"dup_frames"`
+	OutTime     float64 `json:"out_time_seconds"`
+	Uptime      float64 `json:"uptime_seconds"`
+	UpdatedAt   int64   `json:"updated_at"` // Unix timestamp (milliseconds), 0 if no progress was received
+	Slow        bool    `json:"slow"`
+	SlowReports int64   `json:"slow_reports"`
+}
+
+// Progress of all the FFmpeg processes, by name
+var (
+	ffmpegProgressLock sync.Mutex
+	ffmpegProgresses   = make(map[string]*FFmpegProgress)
+)
+
+// Registers the progress of an FFmpeg process
+// If a process with the same name was registered, it is replaced
+func registerFFmpegProgress(name string, debug bool) *FFmpegProgress {
+	p := &FFmpegProgress{
+		lock:      sync.Mutex{},
+		name:      name,
+		debug:     debug,
+		running:   true,
+		startedAt: time.Now(),
+		lastLogAt: time.Now(),
+	}
+
+	ffmpegProgressLock.Lock()
+	ffmpegProgresses[name] = p
+	ffmpegProgressLock.Unlock()
+
+	return p
+}
+
+// Gets the status of all the FFmpeg processes, sorted by name
+func getFFmpegProgressStatus() []FFmpegProgressStatus {
+	ffmpegProgressLock.Lock()
+
+	list := make([]*FFmpegProgress, 0, len(ffmpegProgresses))
+
+	for _, p := range ffmpegProgresses {
+		list = append(list, p)
+	}
+
+	ffmpegProgressLock.Unlock()
+
+	result := make([]FFmpegProgressStatus, 0, len(list))
+
+	for _, p := range list {
+		result = append(result, p.status())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// Reads the progress reported by FFmpeg (-progress), until the end of the stream
+func (p *FFmpegProgress) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		equalsIndex := strings.Index(line, "=")
+
+		if equalsIndex <= 0 {
+			continue
+		}
+
+		p.update(line[:equalsIndex], strings.TrimSpace(line[equalsIndex+1:]))
+	}
+}
+
+// Updates a progress value
+// The block of values ends with the 'progress' key
+func (p *FFmpegProgress) update(key string, value string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch key {
+	case "frame":
+		p.frame, _ = strconv.ParseInt(value, 10, 64)
+	case "fps":
+		p.fps, _ = strconv.ParseFloat(value, 64)
+	case "bitrate":
+		// Example: 1234.5kbits/s or N/A
+		p.bitrate, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+	case "speed":
+		// Example: 1.01x or N/A
+		p.speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	case "drop_frames":
+		p.dropFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "dup_frames":
+		p.dupFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "out_time_us":
+		outTime, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			p.outTime = time.Duration(outTime) * time.Microsecond
+		}
+	case "progress":
+		p.updatedAt = time.Now()
+		p.checkSpeed()
+
+		if time.Since(p.lastLogAt) >= p.logInterval() {
+			p.lastLogAt = time.Now()
+			fmt.Println("[FFMPEG] [" + p.name + "] frame=" + fmt.Sprint(p.frame) + " fps=" + fmt.Sprint(p.fps) + " bitrate=" + fmt.Sprint(p.bitrate) + "kbps speed=" + fmt.Sprint(p.speed) + "x drop=" + fmt.Sprint(p.dropFrames) + " dup=" + fmt.Sprint(p.dupFrames))
+		}
+
+		if value == "end" {
+			p.running = false
+		}
+	}
+}
+
+// Gets the interval to log the progress summary
+func (p *FFmpegProgress) logInterval() time.Duration {
+	if p.debug {
+		return FFMPEG_PROGRESS_DEBUG_LOG_INTERVAL
+	}
+
+	return FFMPEG_PROGRESS_LOG_INTERVAL
+}
+
+// Checks if the encoding speed is below realtime
+// Called with the lock held
+func (p *FFmpegProgress) checkSpeed() {
+	if p.speed <= 0 {
+		// Unknown (N/A)
+		return
+	}
+
+	if p.speed >= FFMPEG_SLOW_SPEED_THRESHOLD {
+		p.slowSince = time.Time{}
+
+		if p.slow {
+			p.slow = false
+			fmt.Println("[FFMPEG] [" + p.name + "] Encoding speed recovered: " + fmt.Sprint(p.speed) + "x")
+		}
+
+		return
+	}
+
+	if p.slowSince.IsZero() {
+		p.slowSince = time.Now()
+	}
+
+	if !p.slow && time.Since(p.slowSince) >= FFMPEG_SLOW_DELAY {
+		p.slow = true
+		p.slowReports++
+		fmt.Println("[FFMPEG] [" + p.name + "] Warning: Encoding is slower than realtime: " + fmt.Sprint(p.speed) + "x (fps=" + fmt.Sprint(p.fps) + ", dropped frames=" + fmt.Sprint(p.dropFrames) + ")")
+	}
+}
+
+// Marks the process as ended
+func (p *FFmpegProgress) end() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.running = false
+}
+
+// Gets the status of the process
+func (p *FFmpegProgress) status() FFmpegProgressStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := FFmpegProgressStatus{
+		Name:        p.name,
+		Running:     p.running,
+		Frame:       p.frame,
+		FPS:         p.fps,
+		Bitrate:     p.bitrate,
+		Speed:       p.speed,
+		DropFrames:  p.dropFrames,
+		DupFrames:   p.dupFrames,
+		OutTime:     p.outTime.Seconds(),
+		Uptime:      time.Since(p.startedAt).Seconds(),
+		Slow:        p.slow,
+		SlowReports: p.slowReports,
+	}
+
+	if !p.updatedAt.IsZero() {
+		status.UpdatedAt = p.updatedAt.UnixMilli()
+	}
+
+	return status
+}
+
+// Registers the status and metrics handlers in the built-in HTTP server
+func registerStatusHandlers() {
+	httpMux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		processes := getFFmpegProgressStatus()
+
+		healthy := true
+
+		for _, p := range processes {
+			if p.Slow {
+				healthy = false
+			}
+		}
+
+		body, err := json.Marshal(map[string]interface{}{
+			"healthy":   healthy,
+			"processes": processes,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(body)
+	})
+
+	httpMux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(formatFFmpegMetrics(getFFmpegProgressStatus())))
+	})
+}
+
+// Formats the metrics of the FFmpeg processes (Prometheus text format)
+func formatFFmpegMetrics(processes []FFmpegProgressStatus) string {
+	b := strings.Builder{}
+
+	metric := func(name string, kind string, help string, value func(FFmpegProgressStatus) string) {
+		b.WriteString("# HELP " + name + " " + help + "\n")
+		b.WriteString("# TYPE " + name + " " + kind + "\n")
+
+		for _, p := range processes {
+			b.WriteString(name + "{process=\"" + p.Name + "\"} " + value(p) + "\n")
+		}
+	}
+
+	boolValue := func(v bool) string {
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+
+	metric("webrtc_video_filter_ffmpeg_running", "gauge", "1 if the FFmpeg process is running.", func(p FFmpegProgressStatus) string {
+		return boolValue(p.Running)
+	})
+	metric("webrtc_video_filter_ffmpeg_frames_total", "counter", "Frames encoded.", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.Frame)
+	})
+	metric("webrtc_video_filter_ffmpeg_fps", "gauge", "Encoding framerate.", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.FPS)
+	})
+	metric("webrtc_video_filter_ffmpeg_bitrate_kbps", "gauge", "Output bitrate (kbps).", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.Bitrate)
+	})
+	metric("webrtc_video_filter_ffmpeg_speed", "gauge", "Encoding speed (1 is realtime).", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.Speed)
+	})
+	metric("webrtc_video_filter_ffmpeg_dropped_frames_total", "counter", "Frames dropped.", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.DropFrames)
+	})
+	metric("webrtc_video_filter_ffmpeg_duplicated_frames_total", "counter", "Frames duplicated.", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.DupFrames)
+	})
+	metric("webrtc_video_filter_ffmpeg_slow", "gauge", "1 if the encoding is slower than realtime.", func(p FFmpegProgressStatus) string {
+		return boolValue(p.Slow)
+	})
+	metric("webrtc_video_filter_ffmpeg_slow_reports_total", "counter", "Times the encoding was flagged as slower than realtime.", func(p FFmpegProgressStatus) string {
+		return fmt.Sprint(p.SlowReports)
+	})
+
+	return b.String()
+}
@@ -3,25 +3,74 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"net/url"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 )
 
 type PublishOptions struct {
 	debug       bool
+	port        int
 	ffmpeg      string
-	authToken   string
 	videoFilter string
+	slate       SlateOptions
+	preview     *PreviewServer
+	outputs     []EncoderOutput
+	recorder    *Recorder
+	encoder     EncoderProfile
+
+	signalingTimeout time.Duration
+
+	auth *AuthOptions
+
+	websocket *WebsocketOptions
+}
+
+func runPublish(source EncoderInput, destination StreamEndpoint, options PublishOptions) {
+	outputs := make([]EncoderOutput, 0)
+
+	var videoTrack *webrtc.TrackLocalStaticRTP = nil
+
+	if destination.isWebRTC() || options.preview != nil || options.recorder != nil {
+		var trackOutput EncoderOutput
+		videoTrack, trackOutput = createPublishTrack(options)
+		outputs = append(outputs, trackOutput)
+	}
+
+	switch destination.protocol {
+	case STREAM_PROTOCOL_RTMP:
+		outputs = append(outputs, EncoderOutput{kind: ENCODER_OUTPUT_RTMP, url: destination.url.String()})
+	case STREAM_PROTOCOL_SRT:
+		outputs = append(outputs, EncoderOutput{kind: ENCODER_OUTPUT_SRT, url: destination.url.String()})
+	}
+
+	// Additional outputs are relayed by separate processes, so they can fail without stopping the main one
+	outputs = append(outputs, startOutputRelays(options.ffmpeg, options.outputs, options.debug)...)
+
+	// Start FFMPEG
+	go runEncdingProcess(options.ffmpeg, source, outputs, options.videoFilter, options.debug)
+
+	if options.preview != nil {
+		options.preview.setTrack(videoTrack)
+	}
+
+	switch destination.protocol {
+	case STREAM_PROTOCOL_NONE, STREAM_PROTOCOL_RTMP, STREAM_PROTOCOL_SRT:
+		select {} // Published by FFmpeg
+	case STREAM_PROTOCOL_WHIP:
+		runPublishWHIP(videoTrack, destination, options)
+	default:
+		runPublishWebRTCCDN(videoTrack, destination, options)
+	}
 }
 
-func runPublish(source string, destination url.URL, streamId string, options PublishOptions) {
+// Creates the track to publish, receiving the RTP packets from FFmpeg
+// Returns the track and the FFmpeg output to feed it
+func createPublishTrack(options PublishOptions) (*webrtc.TrackLocalStaticRTP, EncoderOutput) {
 	// Create UDP listener
 	listenerVideo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
 	if err != nil {
@@ -39,224 +88,171 @@ func runPublish(source string, destination url.URL, streamId string, options Pub
 		panic(err)
 	}
 
-	// Pipe tracks and start FFMPEG
-	go pipeTrack(listenerVideo, videoTrack)
-	go runEncdingProcess(options.ffmpeg, source, listenerVideo.LocalAddr().String(), options.videoFilter, options.debug)
+	switcher := NewTrackSwitcher(videoTrack, options.slate.enabled(), options.slate.timeout, options.recorder)
+	go switcher.run()
 
-	// Create peer connection
-	peerConnectionConfig := loadWebRTCConfig() // Load config
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfig)
-	if err != nil {
-		fmt.Println("Error: " + err.Error())
-		return
-	}
+	// Pipe tracks
+	go pipeTrack(listenerVideo, switcher, SWITCHER_INPUT_LIVE)
 
-	// Mutex
-	lock := sync.Mutex{}
+	// Slate
+	if options.slate.enabled() {
+		listenerSlate, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			panic(err)
+		}
 
-	// Connect to websocket
-	if options.debug {
-		fmt.Println("Connecting to " + destination.String())
-	}
-	c, _, err := websocket.DefaultDialer.Dial(destination.String(), nil)
-	if err != nil {
-		fmt.Println("Error: " + err.Error())
+		if options.debug {
+			fmt.Println("UDP Listener openned for slate: " + fmt.Sprint(listenerSlate.LocalAddr().String()))
+		}
+
+		go pipeTrack(listenerSlate, switcher, SWITCHER_INPUT_SLATE)
+		go runSlateProcess(options.ffmpeg, options.slate, options.encoder, options.port, listenerSlate.LocalAddr().String(), options.debug)
 	}
-	defer c.Close()
 
-	go func() {
-		for {
-			time.Sleep(20 * time.Second)
+	return videoTrack, EncoderOutput{kind: ENCODER_OUTPUT_RTP, url: listenerVideo.LocalAddr().String(), filter: options.encoder.filter(), encoder: options.encoder}
+}
 
-			// Send hearbeat message
-			heartbeatMessage := SignalingMessage{
-				method: "HEARTBEAT",
-				params: nil,
-				body:   "",
-			}
+// Delay to retry publishing after a retryable signaling error
+const PUBLISH_RETRY_DELAY = 5 * time.Second
 
-			lock.Lock()
-			sendErr := c.WriteMessage(websocket.TextMessage, []byte(heartbeatMessage.serialize()))
-			lock.Unlock()
+// Publishes the track to a webrtc-cdn node
+// Retries after retryable signaling errors
+func runPublishWebRTCCDN(videoTrack *webrtc.TrackLocalStaticRTP, destination StreamEndpoint, options PublishOptions) {
+	for {
+		err := runPublishSessionWebRTCCDN(videoTrack, destination, options)
 
-			if options.debug {
-				fmt.Println("[DESTINATION] >>>\n" + string(heartbeatMessage.serialize()))
-			}
+		if err == nil {
+			killProcess()
+			return
+		}
 
-			if sendErr != nil {
-				return
-			}
+		fmt.Println("[DESTINATION] Error: " + err.Error())
+
+		var signalingErr *SignalingError
+
+		if !errors.As(err, &signalingErr) || !signalingErr.retryable {
+			exitProcess(1)
 		}
-	}()
+
+		fmt.Println("[DESTINATION] Retrying in " + fmt.Sprint(PUBLISH_RETRY_DELAY) + "...")
+		time.Sleep(PUBLISH_RETRY_DELAY)
+	}
+}
+
+// Runs a publishing session
+// Returns nil if the session ended normally
+func runPublishSessionWebRTCCDN(videoTrack *webrtc.TrackLocalStaticRTP, destination StreamEndpoint, options PublishOptions) error {
+	// Get a fresh token for every session
+	authToken, err := options.auth.getToken(AUTH_ROLE_PUBLISH, destination.streamId)
+	if err != nil {
+		return &SignalingError{message: "could not get the authentication token: " + err.Error(), retryable: true}
+	}
+
+	// Connect to websocket (shared with other sessions to the same node)
+	client, err := getSignalingClient(destination, options.websocket, options.debug)
+	if err != nil {
+		return err
+	}
+	defer client.release()
 
 	// Send publish message
-	pubMsg := SignalingMessage{
-		method: "PUBLISH",
-		params: make(map[string]string),
-		body:   "",
+	req, err := client.publish(destination.streamId, authToken)
+	if err != nil {
+		return err
 	}
-	pubMsg.params["Request-ID"] = "pub01"
-	pubMsg.params["Stream-ID"] = streamId
-	pubMsg.params["Stream-Type"] = "VIDEO"
-	if options.authToken != "" {
-		pubMsg.params["Auth"] = options.authToken
+	defer req.close()
+
+	offer, err := req.waitOffer(options.signalingTimeout)
+	if err != nil {
+		return err
 	}
-	c.WriteMessage(websocket.TextMessage, []byte(pubMsg.serialize()))
 
-	if options.debug {
-		fmt.Println("[DESTINATION] >>>\n" + string(pubMsg.serialize()))
+	// Create peer connection
+	peerConnectionConfig := loadWebRTCConfig(WEBRTC_LEG_DESTINATION) // Load config
+	peerConnection, err := createWebRTCAPI(WEBRTC_LEG_DESTINATION).NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		return err
 	}
+	defer peerConnection.Close()
+
+	negotiator := NewSignalingNegotiator(peerConnection, req, "[DESTINATION]")
 
 	// ICE Candidate handler
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-		lock.Lock()
-		defer lock.Unlock()
-
-		candidateMsg := SignalingMessage{
-			method: "CANDIDATE",
-			params: make(map[string]string),
-			body:   "",
-		}
-		candidateMsg.params["Request-ID"] = "pub01"
-		candidateMsg.params["Stream-ID"] = streamId
-		if i != nil {
-			b, e := json.Marshal(i.ToJSON())
-			if e != nil {
-				fmt.Println("Error: " + e.Error())
-			} else {
-				candidateMsg.body = string(b)
-			}
-		}
-
-		c.WriteMessage(websocket.TextMessage, []byte(candidateMsg.serialize()))
-		if options.debug {
-			fmt.Println("[DESTINATION] >>>\n" + string(candidateMsg.serialize()))
+		err := req.sendCandidate(i)
+		if err != nil && options.debug {
+			fmt.Println("[DESTINATION] Error: " + err.Error())
 		}
 	})
 
 	// Connection status handler
-	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		lock.Lock()
-		defer lock.Unlock()
+	// If the connection fails (ICE restart did not recover it), the request is closed
+	var connectionLost atomic.Bool
 
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
 			fmt.Println("[DESTINATION] WebRTC: Disconnected")
+			connectionLost.Store(true)
+			req.close()
+		} else if state == webrtc.PeerConnectionStateDisconnected {
+			fmt.Println("[DESTINATION] WebRTC: Connection interrupted")
 		} else if state == webrtc.PeerConnectionStateConnected {
 			fmt.Println("[DESTINATION] WebRTC: Connected")
 		}
-	})
-
-	receivedOffer := false
-	closed := false
-
-	// Read websocket messages
-	for {
-		if closed {
-			return
-		}
-		func() {
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				closed = true
-				killProcess()
-				return // Closed
-			}
-
-			if options.debug {
-				fmt.Println("<<<\n" + string(message))
-			}
-
-			msg := parseSignalingMessage(string(message))
-
-			lock.Lock()
-			defer lock.Unlock()
-
-			if msg.method == "ERROR" {
-				fmt.Println("Error: " + msg.params["error-message"])
-				killProcess()
-			} else if msg.method == "OFFER" {
-				if !receivedOffer {
-					receivedOffer = true
-
-					// Set remote rescription
-
-					sd := webrtc.SessionDescription{}
-
-					err := json.Unmarshal([]byte(msg.body), &sd)
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					err = peerConnection.SetRemoteDescription(sd)
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
 
-					// Add tracks
-
-					videoSender, err := peerConnection.AddTrack(videoTrack)
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					go readPacketsFromRTPSender(videoSender)
-
-					// Generate answer
-					answer, err := peerConnection.CreateAnswer(nil)
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					// Sets the LocalDescription, and starts our UDP listeners
-					err = peerConnection.SetLocalDescription(answer)
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					// Send ANSWER to the client
-
-					answerJSON, e := json.Marshal(answer)
-
-					if e != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					answerMsg := SignalingMessage{
-						method: "ANSWER",
-						params: make(map[string]string),
-						body:   string(answerJSON),
-					}
-					answerMsg.params["Request-ID"] = "pub01"
-					answerMsg.params["Stream-ID"] = streamId
-
-					c.WriteMessage(websocket.TextMessage, []byte(answerMsg.serialize()))
+		negotiator.onConnectionStateChange(state)
+	})
 
-					if options.debug {
-						fmt.Println("[DESTINATION] >>>\n" + string(answerMsg.serialize()))
-					}
-				}
-			} else if msg.method == "CANDIDATE" {
-				if receivedOffer && msg.body != "" {
-					candidate := webrtc.ICECandidateInit{}
+	// Set remote rescription
+	err = negotiator.setRemoteOffer(offer.description)
+	if err != nil {
+		return err
+	}
 
-					err := json.Unmarshal([]byte(msg.body), &candidate)
+	// Add tracks
+	videoSender, err := peerConnection.AddTrack(videoTrack)
+	if err != nil {
+		return err
+	}
 
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
+	go readPacketsFromRTPSender(videoSender)
 
-					err = peerConnection.AddICECandidate(candidate)
+	// Send ANSWER to the server
+	err = negotiator.answer()
+	if err != nil {
+		return err
+	}
 
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-				}
-			} else if msg.method == "CLOSE" {
-				fmt.Println("[DESTINATION] Connection closed by remote host.")
-				killProcess()
+	// Handle signaling messages until the session ends
+	for msg := range req.messages {
+		switch m := msg.(type) {
+		case SignalingCandidate:
+			err := negotiator.onCandidate(m)
+			if err != nil {
+				fmt.Println("[DESTINATION] Error: " + err.Error())
+			}
+		case SignalingOffer:
+			// Renegotiation, the track is kept in the existing transceiver
+			err := negotiator.onOffer(m.description)
+			if err != nil {
+				return &SignalingError{message: "renegotiation failed: " + err.Error(), retryable: true}
 			}
-		}()
+		case SignalingAnswer:
+			err := negotiator.onAnswer(m.description)
+			if err != nil {
+				fmt.Println("[DESTINATION] Error: " + err.Error())
+			}
+		case SignalingClose:
+			fmt.Println("[DESTINATION] Connection closed by remote host.")
+			return nil
+		case SignalingErrorMessage:
+			return newSignalingErrorFromMessage(m)
+		}
 	}
+
+	if connectionLost.Load() {
+		return &SignalingError{message: "WebRTC connection lost", retryable: true}
+	}
+
+	return nil // Connection closed
 }
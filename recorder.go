@@ -0,0 +1,238 @@
+// Recording of the source and the filtered output
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const RECORDER_MAX_LATE_PACKETS = 128
+
+// Recording options
+type RecordingOptions struct {
+	sourceTemplate  string        // File name template for the source recording
+	outputTemplate  string        // File name template for the filtered output recording
+	segmentDuration time.Duration // Max duration of each file (0 = no limit)
+	segmentSize     int64         // Max size of each file in bytes (0 = no limit)
+}
+
+// Records a VP8 RTP stream into WebM / Matroska files
+type Recorder struct {
+	lock sync.Mutex
+
+	kind     string
+	template string
+	streamId string
+
+	segmentDuration time.Duration
+	segmentSize     int64
+
+	builder *samplebuilder.SampleBuilder
+
+	writer        *WebMWriter
+	fileName      string
+	fileIndex     int
+	lastTimestamp uint32
+	elapsedTicks  int64
+
+	closed bool
+}
+
+// Creates a recorder
+// kind - "source" or "output"
+// template - File name template
+// streamId - Stream ID, for the file name
+func NewRecorder(kind string, template string, streamId string, options RecordingOptions) *Recorder {
+	r := &Recorder{
+		lock:            sync.Mutex{},
+		kind:            kind,
+		template:        template,
+		streamId:        streamId,
+		segmentDuration: options.segmentDuration,
+		segmentSize:     options.segmentSize,
+		builder:         samplebuilder.New(RECORDER_MAX_LATE_PACKETS, &codecs.VP8Packet{}, 90000),
+	}
+
+	addShutdownHook(r.close)
+
+	return r
+}
+
+// Generates the file name from the template
+// Placeholders: {stream}, {kind}, {date}, {time}, {timestamp}, {index}
+// If the template has no {index}, it is appended, so every file name is unique
+func (r *Recorder) generateFileName() string {
+	now := time.Now()
+
+	fileName := r.template
+	fileName = strings.ReplaceAll(fileName, "{stream}", r.streamId)
+	fileName = strings.ReplaceAll(fileName, "{kind}", r.kind)
+	fileName = strings.ReplaceAll(fileName, "{date}", now.Format("20060102"))
+	fileName = strings.ReplaceAll(fileName, "{time}", now.Format("150405"))
+	fileName = strings.ReplaceAll(fileName, "{timestamp}", fmt.Sprint(now.Unix()))
+	fileName = strings.ReplaceAll(fileName, "{index}", fmt.Sprint(r.fileIndex))
+
+	ext := filepath.Ext(fileName)
+
+	if lowerExt := strings.ToLower(ext); lowerExt != ".webm" && lowerExt != ".mkv" {
+		ext = ".webm"
+	} else {
+		fileName = fileName[:len(fileName)-len(ext)]
+	}
+
+	if !strings.Contains(r.template, "{index}") {
+		fileName += "-" + fmt.Sprint(r.fileIndex)
+	}
+
+	return fileName + ext
+}
+
+// Writes a RTP packet to the recording
+func (r *Recorder) writeRTP(packet *rtp.Packet) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.builder.Push(packet.Clone())
+
+	for sample := r.builder.Pop(); sample != nil; sample = r.builder.Pop() {
+		r.writeFrame(sample.Data, sample.PacketTimestamp)
+	}
+}
+
+// Writes a VP8 frame
+func (r *Recorder) writeFrame(data []byte, timestamp uint32) {
+	keyframe := isVP8Keyframe(data)
+
+	if r.writer != nil && keyframe && r.shouldRotate() {
+		r.closeFile()
+	}
+
+	if r.writer == nil {
+		if !keyframe {
+			return // Files must start with a keyframe
+		}
+
+		width, height := getVP8KeyframeSize(data)
+
+		writer, err := r.createFile(width, height)
+		if err != nil {
+			fmt.Println("[RECORDER] Error: " + err.Error())
+			return
+		}
+
+		fmt.Println("[RECORDER] Recording " + r.kind + " to " + r.fileName)
+
+		r.writer = writer
+		r.lastTimestamp = timestamp
+		r.elapsedTicks = 0
+	}
+
+	// Timecode in milliseconds, relative to the first frame of the file
+	r.elapsedTicks += int64(int32(timestamp - r.lastTimestamp))
+	r.lastTimestamp = timestamp
+
+	timecode := r.elapsedTicks / 90
+
+	if timecode < 0 {
+		timecode = 0
+	}
+
+	err := r.writer.writeFrame(data, keyframe, timecode)
+	if err != nil {
+		fmt.Println("[RECORDER] Error: " + err.Error())
+		r.closeFile()
+	}
+}
+
+// Creates the next file of the recording
+// Existing files are never overwritten, the index is increased instead
+func (r *Recorder) createFile(width int, height int) (*WebMWriter, error) {
+	for {
+		r.fileName = r.generateFileName()
+		r.fileIndex++
+
+		err := os.MkdirAll(filepath.Dir(r.fileName), 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		writer, err := NewWebMWriter(r.fileName, strings.ToLower(filepath.Ext(r.fileName)) == ".mkv", width, height)
+		if os.IsExist(err) {
+			continue
+		}
+
+		return writer, err
+	}
+}
+
+// Checks if the current file reached the max duration or size
+func (r *Recorder) shouldRotate() bool {
+	if r.segmentDuration > 0 && time.Duration(r.writer.getDuration())*time.Millisecond >= r.segmentDuration {
+		return true
+	}
+
+	if r.segmentSize > 0 && r.writer.getSize() >= r.segmentSize {
+		return true
+	}
+
+	return false
+}
+
+func (r *Recorder) closeFile() {
+	if r.writer == nil {
+		return
+	}
+
+	err := r.writer.close()
+	if err != nil {
+		fmt.Println("[RECORDER] Error: " + err.Error())
+	} else {
+		fmt.Println("[RECORDER] Finished " + r.kind + " recording: " + r.fileName)
+	}
+
+	r.writer = nil
+}
+
+// Closes the recorder, finalizing the current file
+func (r *Recorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+	r.closeFile()
+}
+
+// Checks if a VP8 frame is a keyframe
+func isVP8Keyframe(data []byte) bool {
+	return len(data) > 0 && data[0]&0x01 == 0
+}
+
+// Reads the size of a VP8 keyframe
+func getVP8KeyframeSize(data []byte) (int, int) {
+	if len(data) < 10 || data[3] != 0x9D || data[4] != 0x01 || data[5] != 0x2A {
+		return 0, 0
+	}
+
+	width := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3FFF)
+	height := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3FFF)
+
+	return width, height
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a minimal VP8 frame
+func makeTestVP8Frame(keyframe bool) []byte {
+	frame := make([]byte, 100)
+
+	if keyframe {
+		// Keyframe start code and size (320x240)
+		copy(frame, []byte{0x00, 0x00, 0x00, 0x9D, 0x01, 0x2A, 0x40, 0x01, 0xF0, 0x00})
+	} else {
+		frame[0] = 0x01
+	}
+
+	return frame
+}
+
+// Records 3 segments (rotating by size) and returns the files in the directory
+func recordTestSegments(t *testing.T, dir string, template string) []string {
+	t.Helper()
+
+	r := NewRecorder("output", filepath.Join(dir, template), "stream1", RecordingOptions{segmentSize: 1})
+
+	for i := 0; i < 3; i++ {
+		r.writeFrame(makeTestVP8Frame(true), uint32(i*9000))
+		r.writeFrame(makeTestVP8Frame(false), uint32(i*9000+3000))
+	}
+
+	r.close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() == 0 {
+			t.Fatalf("empty file: %s", entry.Name())
+		}
+
+		files = append(files, entry.Name())
+	}
+
+	return files
+}
+
+func TestRecorderRotationWithoutIndex(t *testing.T) {
+	for _, template := range []string{"{stream}", "{stream}-{time}.webm", "{stream}.mkv"} {
+		dir := t.TempDir()
+
+		files := recordTestSegments(t, dir, template)
+
+		if len(files) != 3 {
+			t.Fatalf("template %s: expected 3 files, got %v", template, files)
+		}
+	}
+}
+
+func TestRecorderRotationWithIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	files := recordTestSegments(t, dir, "{stream}-{index}.webm")
+
+	expected := []string{"stream1-0.webm", "stream1-1.webm", "stream1-2.webm"}
+
+	if len(files) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, files)
+	}
+
+	for i := range expected {
+		if files[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, files)
+		}
+	}
+}
+
+func TestRecorderDoesNotOverwrite(t *testing.T) {
+	dir := t.TempDir()
+
+	existing := filepath.Join(dir, "stream1-0.webm")
+
+	err := os.WriteFile(existing, []byte("previous recording"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := recordTestSegments(t, dir, "{stream}.webm")
+
+	if len(files) != 4 {
+		t.Fatalf("expected 4 files, got %v", files)
+	}
+
+	data, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "previous recording" {
+		t.Fatal("the existing file was overwritten")
+	}
+}
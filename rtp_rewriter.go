@@ -0,0 +1,83 @@
+// RTP header rewriter
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Rewrites the RTP headers (SSRC, sequence number, timestamp)
+// in order to keep a continuous stream when the input changes
+type RTPRewriter struct {
+	lock sync.Mutex
+
+	clockRate uint32
+
+	ssrc uint32
+
+	started bool
+	resync  bool
+
+	seqOffset uint16
+	tsOffset  uint32
+
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastTime      time.Time
+}
+
+// Creates new RTP rewriter
+// clockRate - Clock rate of the stream (90000 for video)
+func NewRTPRewriter(clockRate uint32) *RTPRewriter {
+	return &RTPRewriter{
+		lock:      sync.Mutex{},
+		clockRate: clockRate,
+	}
+}
+
+// Indicates the input changed
+// The next packet will be placed right after the last written one
+func (r *RTPRewriter) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.resync = true
+}
+
+// Rewrites the packet headers
+func (r *RTPRewriter) rewrite(packet *rtp.Packet) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	if !r.started {
+		r.started = true
+		r.resync = false
+		r.ssrc = packet.SSRC
+		r.seqOffset = 0
+		r.tsOffset = 0
+	} else if r.resync {
+		r.resync = false
+
+		elapsedTicks := uint32(now.Sub(r.lastTime).Seconds() * float64(r.clockRate))
+
+		if elapsedTicks == 0 {
+			elapsedTicks = 1
+		}
+
+		r.seqOffset = r.lastSeq + 1 - packet.SequenceNumber
+		r.tsOffset = r.lastTimestamp + elapsedTicks - packet.Timestamp
+	}
+
+	packet.SSRC = r.ssrc
+	packet.SequenceNumber += r.seqOffset
+	packet.Timestamp += r.tsOffset
+
+	r.lastSeq = packet.SequenceNumber
+	r.lastTimestamp = packet.Timestamp
+	r.lastTime = now
+}
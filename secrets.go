@@ -0,0 +1,135 @@
+// Secrets (command line, environment variables or files)
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret value
+// If loaded from a file, the file is read again when it changes,
+// so rotated secrets are applied to new sessions
+type Secret struct {
+	lock sync.Mutex
+
+	value string
+
+	file    string    // File to read the value from
+	modTime time.Time // Modification time of the file when read
+	size    int64     // Size of the file when read
+}
+
+// Creates new empty secret
+func NewSecret() *Secret {
+	return &Secret{
+		lock: sync.Mutex{},
+	}
+}
+
+// Sets the value
+func (s *Secret) set(value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.value = value
+	s.file = ""
+}
+
+// Sets the file to read the value from
+func (s *Secret) setFile(file string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.file = file
+	s.modTime = time.Time{}
+	s.size = 0
+
+	return s.reload()
+}
+
+// Loads the secret from environment variables
+// NAME contains the value, NAME_FILE the path of a file containing it
+func (s *Secret) loadFromEnv(name string) error {
+	if value := os.Getenv(name); value != "" {
+		s.set(value)
+		return nil
+	}
+
+	if file := os.Getenv(name + "_FILE"); file != "" {
+		return s.setFile(file)
+	}
+
+	return nil
+}
+
+// Checks if the secret is set
+func (s *Secret) isSet() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.value != "" || s.file != ""
+}
+
+// Gets the value, reading the file again if it changed
+func (s *Secret) get() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file != "" {
+		err := s.reload()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return s.value, nil
+}
+
+// Reads the file, if it changed since the last time
+// Called with the lock held
+func (s *Secret) reload() error {
+	content, modTime, size, changed, err := readFileIfChanged(s.file, s.modTime, s.size)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	value := strings.TrimSpace(string(content))
+
+	if value == "" {
+		return errors.New("empty secret file: " + s.file)
+	}
+
+	s.value = value
+	s.modTime = modTime
+	s.size = size
+
+	return nil
+}
+
+// Reads a file if its modification time or size changed
+// Returns the contents, the new modification time and size, and true if it changed
+func readFileIfChanged(file string, modTime time.Time, size int64) ([]byte, time.Time, int64, bool, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, modTime, size, false, err
+	}
+
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return nil, modTime, size, false, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, modTime, size, false, err
+	}
+
+	return content, info.ModTime(), info.Size(), true, nil
+}
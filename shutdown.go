@@ -0,0 +1,86 @@
+// Process shutdown
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type shutdownHook struct {
+	id   uint64
+	hook func()
+}
+
+var shutdownLock = sync.Mutex{}
+var shutdownHooks = make([]shutdownHook, 0)
+var shutdownHookNextId uint64 = 0
+var shuttingDown = false
+
+// Adds a function to call before the process exits
+// Returns a function to remove the hook
+func addShutdownHook(hook func()) func() {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+
+	id := shutdownHookNextId
+	shutdownHookNextId++
+
+	shutdownHooks = append(shutdownHooks, shutdownHook{id: id, hook: hook})
+
+	return func() {
+		shutdownLock.Lock()
+		defer shutdownLock.Unlock()
+
+		for i, h := range shutdownHooks {
+			if h.id == id {
+				shutdownHooks = append(shutdownHooks[:i], shutdownHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Runs the shutdown hooks, in reverse order
+// Only the first call runs them
+func runShutdownHooks() {
+	shutdownLock.Lock()
+
+	if shuttingDown {
+		shutdownLock.Unlock()
+		return
+	}
+
+	shuttingDown = true
+	hooks := make([]shutdownHook, len(shutdownHooks))
+	copy(hooks, shutdownHooks)
+
+	shutdownLock.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].hook()
+	}
+}
+
+// Kills the process when an interruption signal is received
+func handleShutdownSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		killProcess()
+	}()
+}
+
+// Exits the process, running the shutdown hooks
+func exitProcess(code int) {
+	runShutdownHooks()
+	os.Exit(code)
+}
+
+func killProcess() {
+	exitProcess(0)
+}
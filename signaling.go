@@ -2,7 +2,26 @@
 
 package main
 
-import "strings"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Signaling methods
+const (
+	SIGNALING_METHOD_HEARTBEAT = "HEARTBEAT"
+	SIGNALING_METHOD_PLAY      = "PLAY"
+	SIGNALING_METHOD_PUBLISH   = "PUBLISH"
+	SIGNALING_METHOD_OFFER     = "OFFER"
+	SIGNALING_METHOD_ANSWER    = "ANSWER"
+	SIGNALING_METHOD_CANDIDATE = "CANDIDATE"
+	SIGNALING_METHOD_CLOSE     = "CLOSE"
+	SIGNALING_METHOD_ERROR     = "ERROR"
+)
 
 // Signaling message
 type SignalingMessage struct {
@@ -12,7 +31,8 @@ type SignalingMessage struct {
 }
 
 // Parses signaling message from string message received
-func parseSignalingMessage(raw string) SignalingMessage {
+// Returns an error if the message is malformed
+func parseSignalingMessage(raw string) (SignalingMessage, error) {
 	lines := strings.Split(raw, "\n")
 	msg := SignalingMessage{
 		method: "",
@@ -20,8 +40,16 @@ func parseSignalingMessage(raw string) SignalingMessage {
 		body:   "",
 	}
 
-	if len(lines) > 0 {
-		msg.method = strings.ToUpper(strings.Trim(lines[0], " \n\r\t"))
+	msg.method = strings.ToUpper(strings.Trim(lines[0], " \n\r\t"))
+
+	if msg.method == "" {
+		return msg, errors.New("missing method")
+	}
+
+	for _, c := range msg.method {
+		if (c < 'A' || c > 'Z') && c != '-' && c != '_' {
+			return msg, fmt.Errorf("invalid method: %q", msg.method)
+		}
 	}
 
 	var isBody bool = false
@@ -30,7 +58,11 @@ func parseSignalingMessage(raw string) SignalingMessage {
 	for i := 1; i < len(lines); i++ {
 		line := lines[i]
 
-		if line == "" {
+		if !isBody {
+			line = strings.TrimRight(line, "\r")
+		}
+
+		if line == "" && !isBody {
 			// Found empty line
 			isBody = true
 			continue
@@ -47,15 +79,22 @@ func parseSignalingMessage(raw string) SignalingMessage {
 		} else {
 			// Param
 			colonIndex := strings.Index(line, ":")
-			if colonIndex > 0 {
-				key := strings.ToLower(strings.Trim(line[0:colonIndex], " \n\r\t"))
-				val := strings.Trim(line[colonIndex+1:], " \n\r\t")
-				msg.params[key] = val
+			if colonIndex <= 0 {
+				return msg, fmt.Errorf("malformed parameter at line %d: %q", i+1, line)
+			}
+
+			key := strings.ToLower(strings.Trim(line[0:colonIndex], " \n\r\t"))
+			val := strings.Trim(line[colonIndex+1:], " \n\r\t")
+
+			if key == "" {
+				return msg, fmt.Errorf("malformed parameter at line %d: %q", i+1, line)
 			}
+
+			msg.params[key] = val
 		}
 	}
 
-	return msg
+	return msg, nil
 }
 
 // Serializes signaling message in order to send it
@@ -75,3 +114,232 @@ func (s SignalingMessage) serialize() string {
 
 	return raw
 }
+
+// Gets the request ID of the message
+func (s SignalingMessage) requestId() string {
+	return s.params["request-id"]
+}
+
+// Offer received from the server
+type SignalingOffer struct {
+	requestId   string
+	streamId    string
+	description webrtc.SessionDescription
+}
+
+// Answer received from the server (to an offer sent for an ICE restart)
+type SignalingAnswer struct {
+	requestId   string
+	streamId    string
+	description webrtc.SessionDescription
+}
+
+// Candidate received from the server
+type SignalingCandidate struct {
+	requestId string
+	streamId  string
+	candidate *webrtc.ICECandidateInit // Nil means end of candidates
+}
+
+// Close message received from the server
+type SignalingClose struct {
+	requestId string
+	streamId  string
+}
+
+// Error message received from the server
+type SignalingErrorMessage struct {
+	requestId string
+	code      string
+	message   string
+}
+
+// Heartbeat message
+type SignalingHeartbeat struct{}
+
+// Decodes a message received from the server into its typed form
+// Returns SignalingOffer, SignalingAnswer, SignalingCandidate, SignalingClose, SignalingErrorMessage or SignalingHeartbeat
+func decodeSignalingMessage(msg SignalingMessage) (interface{}, error) {
+	switch msg.method {
+	case SIGNALING_METHOD_HEARTBEAT:
+		return SignalingHeartbeat{}, nil
+	case SIGNALING_METHOD_OFFER:
+		if msg.requestId() == "" {
+			return nil, errors.New("OFFER without Request-ID")
+		}
+
+		sd := webrtc.SessionDescription{}
+
+		if err := json.Unmarshal([]byte(msg.body), &sd); err != nil {
+			return nil, fmt.Errorf("OFFER with invalid body: %s", err.Error())
+		}
+
+		if sd.Type != webrtc.SDPTypeOffer || sd.SDP == "" {
+			return nil, errors.New("OFFER with invalid session description")
+		}
+
+		return SignalingOffer{
+			requestId:   msg.requestId(),
+			streamId:    msg.params["stream-id"],
+			description: sd,
+		}, nil
+	case SIGNALING_METHOD_ANSWER:
+		if msg.requestId() == "" {
+			return nil, errors.New("ANSWER without Request-ID")
+		}
+
+		sd := webrtc.SessionDescription{}
+
+		if err := json.Unmarshal([]byte(msg.body), &sd); err != nil {
+			return nil, fmt.Errorf("ANSWER with invalid body: %s", err.Error())
+		}
+
+		if sd.Type != webrtc.SDPTypeAnswer || sd.SDP == "" {
+			return nil, errors.New("ANSWER with invalid session description")
+		}
+
+		return SignalingAnswer{
+			requestId:   msg.requestId(),
+			streamId:    msg.params["stream-id"],
+			description: sd,
+		}, nil
+	case SIGNALING_METHOD_CANDIDATE:
+		if msg.requestId() == "" {
+			return nil, errors.New("CANDIDATE without Request-ID")
+		}
+
+		result := SignalingCandidate{
+			requestId: msg.requestId(),
+			streamId:  msg.params["stream-id"],
+			candidate: nil,
+		}
+
+		if msg.body != "" {
+			candidate := webrtc.ICECandidateInit{}
+
+			if err := json.Unmarshal([]byte(msg.body), &candidate); err != nil {
+				return nil, fmt.Errorf("CANDIDATE with invalid body: %s", err.Error())
+			}
+
+			if candidate.Candidate != "" {
+				result.candidate = &candidate
+			}
+		}
+
+		return result, nil
+	case SIGNALING_METHOD_CLOSE:
+		return SignalingClose{
+			requestId: msg.requestId(),
+			streamId:  msg.params["stream-id"],
+		}, nil
+	case SIGNALING_METHOD_ERROR:
+		return SignalingErrorMessage{
+			requestId: msg.requestId(),
+			code:      msg.params["error-code"],
+			message:   msg.params["error-message"],
+		}, nil
+	default:
+		return nil, fmt.Errorf("unexpected method: %s", msg.method)
+	}
+}
+
+// Creates a HEARTBEAT message
+func newHeartbeatMessage() SignalingMessage {
+	return SignalingMessage{
+		method: SIGNALING_METHOD_HEARTBEAT,
+		params: nil,
+		body:   "",
+	}
+}
+
+// Creates a PLAY message
+func newPlayMessage(requestId string, streamId string, authToken string) SignalingMessage {
+	msg := SignalingMessage{
+		method: SIGNALING_METHOD_PLAY,
+		params: make(map[string]string),
+		body:   "",
+	}
+	msg.params["Request-ID"] = requestId
+	msg.params["Stream-ID"] = streamId
+	if authToken != "" {
+		msg.params["Auth"] = authToken
+	}
+	return msg
+}
+
+// Creates a PUBLISH message
+func newPublishMessage(requestId string, streamId string, authToken string) SignalingMessage {
+	msg := SignalingMessage{
+		method: SIGNALING_METHOD_PUBLISH,
+		params: make(map[string]string),
+		body:   "",
+	}
+	msg.params["Request-ID"] = requestId
+	msg.params["Stream-ID"] = streamId
+	msg.params["Stream-Type"] = "VIDEO"
+	if authToken != "" {
+		msg.params["Auth"] = authToken
+	}
+	return msg
+}
+
+// Creates an ANSWER message
+func newAnswerMessage(requestId string, streamId string, answer webrtc.SessionDescription) (SignalingMessage, error) {
+	return newDescriptionMessage(SIGNALING_METHOD_ANSWER, requestId, streamId, answer)
+}
+
+// Creates an OFFER message (ICE restart)
+func newOfferMessage(requestId string, streamId string, offer webrtc.SessionDescription) (SignalingMessage, error) {
+	return newDescriptionMessage(SIGNALING_METHOD_OFFER, requestId, streamId, offer)
+}
+
+// Creates a message with a session description
+func newDescriptionMessage(method string, requestId string, streamId string, description webrtc.SessionDescription) (SignalingMessage, error) {
+	descriptionJSON, err := json.Marshal(description)
+	if err != nil {
+		return SignalingMessage{}, err
+	}
+
+	msg := SignalingMessage{
+		method: method,
+		params: make(map[string]string),
+		body:   string(descriptionJSON),
+	}
+	msg.params["Request-ID"] = requestId
+	msg.params["Stream-ID"] = streamId
+	return msg, nil
+}
+
+// Creates a CANDIDATE message
+// Nil candidate means end of candidates
+func newCandidateMessage(requestId string, streamId string, candidate *webrtc.ICECandidateInit) (SignalingMessage, error) {
+	msg := SignalingMessage{
+		method: SIGNALING_METHOD_CANDIDATE,
+		params: make(map[string]string),
+		body:   "",
+	}
+	msg.params["Request-ID"] = requestId
+	msg.params["Stream-ID"] = streamId
+
+	if candidate != nil {
+		b, err := json.Marshal(candidate)
+		if err != nil {
+			return SignalingMessage{}, err
+		}
+		msg.body = string(b)
+	}
+
+	return msg, nil
+}
+
+// Creates a CLOSE message
+func newCloseMessage(requestId string, streamId string) SignalingMessage {
+	msg := SignalingMessage{
+		method: SIGNALING_METHOD_CLOSE,
+		params: make(map[string]string),
+		body:   "",
+	}
+	msg.params["Request-ID"] = requestId
+	msg.params["Stream-ID"] = streamId
+	return msg
+}
@@ -0,0 +1,652 @@
+// Signaling client for webrtc-cdn nodes
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// Default time to wait for a response from the signaling server
+const DEFAULT_SIGNALING_TIMEOUT = 30 * time.Second
+
+// Interval to send HEARTBEAT messages
+const SIGNALING_HEARTBEAT_INTERVAL = 20 * time.Second
+
+// Interval to send websocket pings
+const SIGNALING_PING_INTERVAL = 10 * time.Second
+
+// Max time without receiving anything (messages or pongs) before the connection is considered lost
+const SIGNALING_READ_TIMEOUT = 30 * time.Second
+
+// Max time to write a message
+const SIGNALING_WRITE_TIMEOUT = 10 * time.Second
+
+// Size of the outbound message queue of each connection
+const SIGNALING_SEND_QUEUE_SIZE = 64
+
+// Size of the message queue of each request
+const SIGNALING_REQUEST_QUEUE_SIZE = 32
+
+// Error codes that will not succeed if the request is retried
+// The code is read from the Error-Code parameter of the ERROR messages.
+// Codes containing any of these keywords (case insensitive) are fatal,
+// for example AUTH_ERROR, INVALID_STREAM_ID, PROTOCOL_ERROR or FORBIDDEN.
+// Any other code (or no code at all) is retryable, for example INTERNAL_ERROR.
+var SIGNALING_FATAL_ERROR_KEYWORDS = []string{"AUTH", "INVALID", "PROTOCOL", "FORBIDDEN"}
+
+// Counter to generate request IDs
+var signalingRequestCounter uint64 = 0
+
+// Generates an unique request ID
+func generateSignalingRequestId(prefix string) string {
+	return prefix + "-" + fmt.Sprint(atomic.AddUint64(&signalingRequestCounter, 1))
+}
+
+// Error sent by the signaling server, or produced while waiting for it
+type SignalingError struct {
+	code      string
+	message   string
+	retryable bool
+}
+
+func (e *SignalingError) Error() string {
+	if e.code == "" {
+		return e.message
+	}
+	return e.code + ": " + e.message
+}
+
+// Creates a signaling error from an ERROR message
+func newSignalingErrorFromMessage(msg SignalingErrorMessage) *SignalingError {
+	code := strings.ToUpper(msg.code)
+	retryable := true
+
+	for _, keyword := range SIGNALING_FATAL_ERROR_KEYWORDS {
+		if strings.Contains(code, keyword) {
+			retryable = false
+			break
+		}
+	}
+
+	message := msg.message
+
+	if message == "" {
+		message = "error received from the signaling server"
+	}
+
+	return &SignalingError{
+		code:      msg.code,
+		message:   message,
+		retryable: retryable,
+	}
+}
+
+// Checks if an error is fatal (retrying will not fix it)
+func isFatalSignalingError(err error) bool {
+	var signalingErr *SignalingError
+
+	if errors.As(err, &signalingErr) {
+		return !signalingErr.retryable
+	}
+
+	return false
+}
+
+// Checks if an error is a retryable signaling error
+func isRetryableSignalingError(err error) bool {
+	var signalingErr *SignalingError
+
+	if errors.As(err, &signalingErr) {
+		return signalingErr.retryable
+	}
+
+	return false
+}
+
+// Signaling client
+// Owns a websocket connection to a node, shared by all the requests to that node
+type SignalingClient struct {
+	lock sync.Mutex
+
+	conn *websocket.Conn
+
+	key  string // Key in the client manager
+	name string // Node name (for logs)
+
+	debug bool
+
+	requests map[string]*SignalingRequest
+
+	refs int // Number of users of the client
+
+	// Outbound messages, written by a single goroutine
+	outbound chan string
+
+	closed bool
+	done   chan struct{} // Closed when the connection is closed
+
+	draining bool
+	drain    chan struct{} // Closed when the client is no longer used, to write the queued messages and close
+}
+
+// Manager of the signaling clients
+// Keeps a single connection per node
+type SignalingClientManager struct {
+	lock sync.Mutex
+
+	clients map[string]*SignalingClient
+}
+
+var signalingClientManager = &SignalingClientManager{
+	lock:    sync.Mutex{},
+	clients: make(map[string]*SignalingClient),
+}
+
+// Gets the signaling client for the node of an endpoint, connecting to it if needed
+// Call release() when the client is no longer used
+func getSignalingClient(endpoint StreamEndpoint, wsOptions *WebsocketOptions, debug bool) (*SignalingClient, error) {
+	u := endpoint.url
+	u.Path = wsOptions.path // The endpoint URL has no path
+
+	key := u.String()
+
+	if client := signalingClientManager.acquire(key); client != nil {
+		return client, nil
+	}
+
+	client, err := dialSignalingClient(key, endpoint.url.Host, wsOptions, debug)
+	if err != nil {
+		return nil, err
+	}
+
+	signalingClientManager.lock.Lock()
+
+	if existing := signalingClientManager.clients[key]; existing != nil && existing.acquire() {
+		signalingClientManager.lock.Unlock()
+
+		// Connected concurrently, use the other connection
+		client.close()
+		return existing, nil
+	}
+
+	signalingClientManager.clients[key] = client
+
+	signalingClientManager.lock.Unlock()
+
+	return client, nil
+}
+
+// Gets an existing client, adding a reference
+func (m *SignalingClientManager) acquire(key string) *SignalingClient {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	client := m.clients[key]
+
+	if client == nil || !client.acquire() {
+		return nil
+	}
+
+	return client
+}
+
+// Removes a client, if it is the one registered for its node
+func (m *SignalingClientManager) remove(client *SignalingClient) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.clients[client.key] == client {
+		delete(m.clients, client.key)
+	}
+}
+
+// Connects to a webrtc-cdn node
+func dialSignalingClient(key string, name string, wsOptions *WebsocketOptions, debug bool) (*SignalingClient, error) {
+	if debug {
+		fmt.Println("[SIGNALING] Connecting to " + key)
+	}
+
+	conn, err := wsOptions.dial(key)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &SignalingClient{
+		lock:     sync.Mutex{},
+		conn:     conn,
+		key:      key,
+		name:     name,
+		debug:    debug,
+		requests: make(map[string]*SignalingRequest),
+		refs:     1,
+		outbound: make(chan string, SIGNALING_SEND_QUEUE_SIZE),
+		closed:   false,
+		done:     make(chan struct{}),
+		draining: false,
+		drain:    make(chan struct{}),
+	}
+
+	go client.readLoop()
+	go client.writeLoop()
+
+	return client, nil
+}
+
+// Adds a reference to the client
+// Returns false if the client is closed
+func (c *SignalingClient) acquire() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed || c.draining {
+		return false
+	}
+
+	c.refs++
+
+	return true
+}
+
+// Removes a reference to the client
+// When it is no longer used, the queued messages (e.g. CLOSE) are written
+// and the connection is closed
+func (c *SignalingClient) release() {
+	signalingClientManager.lock.Lock()
+	c.lock.Lock()
+
+	c.refs--
+
+	if c.refs > 0 || c.closed || c.draining {
+		c.lock.Unlock()
+		signalingClientManager.lock.Unlock()
+		return
+	}
+
+	// No new requests can use this client
+	c.draining = true
+	close(c.drain)
+
+	if signalingClientManager.clients[c.key] == c {
+		delete(signalingClientManager.clients, c.key)
+	}
+
+	c.lock.Unlock()
+	signalingClientManager.lock.Unlock()
+}
+
+// Queues a message to be sent
+// Returns a retryable error if the connection is closed or the queue is full
+func (c *SignalingClient) send(msg SignalingMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed || c.draining {
+		return &SignalingError{message: "signaling connection closed", retryable: true}
+	}
+
+	select {
+	case c.outbound <- msg.serialize():
+		return nil
+	default:
+		return &SignalingError{message: "signaling send queue full", retryable: true}
+	}
+}
+
+// Writes the outbound messages, pings and heartbeats
+// This is the only goroutine writing to the connection
+func (c *SignalingClient) writeLoop() {
+	defer c.close()
+
+	pingTicker := time.NewTicker(SIGNALING_PING_INTERVAL)
+	defer pingTicker.Stop()
+
+	heartbeatTicker := time.NewTicker(SIGNALING_HEARTBEAT_INTERVAL)
+	defer heartbeatTicker.Stop()
+
+	heartbeat := newHeartbeatMessage().serialize()
+
+	for {
+		var err error
+
+		select {
+		case raw := <-c.outbound:
+			err = c.write(raw)
+		case <-heartbeatTicker.C:
+			err = c.write(heartbeat)
+		case <-pingTicker.C:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(SIGNALING_WRITE_TIMEOUT))
+		case <-c.drain:
+			c.writeQueued()
+			return
+		case <-c.done:
+			return
+		}
+
+		if err != nil {
+			if c.debug {
+				fmt.Println("[SIGNALING] [" + c.name + "] Write error: " + err.Error())
+			}
+			return
+		}
+	}
+}
+
+// Writes the queued messages and a close frame, before closing the connection
+// All the writes must finish before the write timeout
+func (c *SignalingClient) writeQueued() {
+	deadline := time.Now().Add(SIGNALING_WRITE_TIMEOUT)
+
+	for {
+		select {
+		case raw := <-c.outbound:
+			err := c.writeWithDeadline(raw, deadline)
+			if err != nil {
+				if c.debug {
+					fmt.Println("[SIGNALING] [" + c.name + "] Write error: " + err.Error())
+				}
+				return
+			}
+		default:
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+			return
+		}
+	}
+}
+
+// Writes a message to the connection
+func (c *SignalingClient) write(raw string) error {
+	return c.writeWithDeadline(raw, time.Now().Add(SIGNALING_WRITE_TIMEOUT))
+}
+
+// Writes a message to the connection, with a deadline
+func (c *SignalingClient) writeWithDeadline(raw string, deadline time.Time) error {
+	if c.debug {
+		fmt.Println("[SIGNALING] [" + c.name + "] >>>\n" + raw)
+	}
+
+	err := c.conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(raw))
+}
+
+// Reads messages until the connection is closed
+func (c *SignalingClient) readLoop() {
+	defer c.close()
+
+	c.conn.SetReadDeadline(time.Now().Add(SIGNALING_READ_TIMEOUT))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(SIGNALING_READ_TIMEOUT))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if c.debug {
+				fmt.Println("[SIGNALING] [" + c.name + "] Connection closed: " + err.Error())
+			}
+			return
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(SIGNALING_READ_TIMEOUT))
+
+		if c.debug {
+			fmt.Println("[SIGNALING] [" + c.name + "] <<<\n" + string(message))
+		}
+
+		msg, err := parseSignalingMessage(string(message))
+		if err != nil {
+			fmt.Println("[SIGNALING] [" + c.name + "] Error: Malformed signaling message: " + err.Error())
+			continue
+		}
+
+		decoded, err := decodeSignalingMessage(msg)
+		if err != nil {
+			fmt.Println("[SIGNALING] [" + c.name + "] Error: Invalid signaling message: " + err.Error())
+			continue
+		}
+
+		c.dispatch(msg.requestId(), decoded)
+	}
+}
+
+// Routes a message to its request
+// Messages without a request ID (other than heartbeats) are sent to every request
+func (c *SignalingClient) dispatch(requestId string, decoded interface{}) {
+	if _, ok := decoded.(SignalingHeartbeat); ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if requestId == "" {
+		for _, req := range c.requests {
+			req.push(decoded)
+		}
+		return
+	}
+
+	req := c.requests[requestId]
+
+	if req == nil {
+		if c.debug {
+			fmt.Println("[SIGNALING] [" + c.name + "] Ignored message for unknown request: " + requestId)
+		}
+		return
+	}
+
+	req.push(decoded)
+}
+
+// Closes the connection, ending all the requests
+func (c *SignalingClient) close() {
+	signalingClientManager.remove(c)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	close(c.done)
+	c.conn.Close()
+
+	for id, req := range c.requests {
+		req.end()
+		delete(c.requests, id)
+	}
+}
+
+// Starts a request
+func (c *SignalingClient) startRequest(msg SignalingMessage, requestId string, streamId string) (*SignalingRequest, error) {
+	req := &SignalingRequest{
+		client:   c,
+		id:       requestId,
+		streamId: streamId,
+		messages: make(chan interface{}, SIGNALING_REQUEST_QUEUE_SIZE),
+		ended:    false,
+	}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, &SignalingError{message: "signaling connection closed", retryable: true}
+	}
+	c.requests[requestId] = req
+	c.lock.Unlock()
+
+	err := c.send(msg)
+
+	if err != nil {
+		req.remove()
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// Sends a PLAY request
+func (c *SignalingClient) play(streamId string, authToken string) (*SignalingRequest, error) {
+	requestId := generateSignalingRequestId("play")
+	return c.startRequest(newPlayMessage(requestId, streamId, authToken), requestId, streamId)
+}
+
+// Sends a PUBLISH request
+func (c *SignalingClient) publish(streamId string, authToken string) (*SignalingRequest, error) {
+	requestId := generateSignalingRequestId("pub")
+	return c.startRequest(newPublishMessage(requestId, streamId, authToken), requestId, streamId)
+}
+
+// Signaling request (PLAY or PUBLISH)
+type SignalingRequest struct {
+	client *SignalingClient
+
+	id       string
+	streamId string
+
+	// Received messages, closed when the request ends
+	messages chan interface{}
+
+	ended        bool
+	remoteClosed bool // True if the server ended the request (CLOSE or ERROR)
+
+	// Candidates received before the offer
+	earlyCandidates []SignalingCandidate
+}
+
+// Queues a received message
+// Called with the client lock held
+func (r *SignalingRequest) push(msg interface{}) {
+	if r.ended {
+		return
+	}
+
+	switch msg.(type) {
+	case SignalingClose, SignalingErrorMessage:
+		r.remoteClosed = true
+	}
+
+	select {
+	case r.messages <- msg:
+	default:
+		fmt.Println("[SIGNALING] [" + r.client.name + "] Error: Message queue full. Dropped message for request " + r.id)
+	}
+}
+
+// Ends the request
+// Called with the client lock held
+func (r *SignalingRequest) end() {
+	if r.ended {
+		return
+	}
+
+	r.ended = true
+	close(r.messages)
+}
+
+// Removes the request from the client
+// Returns true if the request was still active in the server
+func (r *SignalingRequest) remove() bool {
+	r.client.lock.Lock()
+	defer r.client.lock.Unlock()
+
+	active := !r.client.closed && !r.ended && !r.remoteClosed
+
+	r.end()
+	delete(r.client.requests, r.id)
+
+	return active
+}
+
+// Ends the request, sending CLOSE to the server
+// The connection is kept for other requests to the same node
+func (r *SignalingRequest) close() {
+	if r.remove() {
+		r.client.send(newCloseMessage(r.id, r.streamId))
+	}
+}
+
+// Waits for the OFFER of the server
+// Returns an error if the server sends an ERROR or CLOSE, or the timeout is reached
+func (r *SignalingRequest) waitOffer(timeout time.Duration) (SignalingOffer, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-r.messages:
+			if !ok {
+				return SignalingOffer{}, &SignalingError{message: "signaling connection closed", retryable: true}
+			}
+
+			switch m := msg.(type) {
+			case SignalingOffer:
+				return m, nil
+			case SignalingCandidate:
+				// Reordered or early candidate, applied after the offer
+				r.earlyCandidates = append(r.earlyCandidates, m)
+			case SignalingErrorMessage:
+				return SignalingOffer{}, newSignalingErrorFromMessage(m)
+			case SignalingClose:
+				return SignalingOffer{}, &SignalingError{message: "request closed by the server", retryable: true}
+			}
+		case <-timer.C:
+			return SignalingOffer{}, &SignalingError{message: "timed out waiting for OFFER", retryable: true}
+		}
+	}
+}
+
+// Gets the candidates received before the offer, clearing them
+func (r *SignalingRequest) takeEarlyCandidates() []SignalingCandidate {
+	candidates := r.earlyCandidates
+	r.earlyCandidates = nil
+	return candidates
+}
+
+// Sends the ANSWER
+func (r *SignalingRequest) sendAnswer(answer webrtc.SessionDescription) error {
+	msg, err := newAnswerMessage(r.id, r.streamId, answer)
+	if err != nil {
+		return err
+	}
+	return r.client.send(msg)
+}
+
+// Sends an OFFER (ICE restart)
+func (r *SignalingRequest) sendOffer(offer webrtc.SessionDescription) error {
+	msg, err := newOfferMessage(r.id, r.streamId, offer)
+	if err != nil {
+		return err
+	}
+	return r.client.send(msg)
+}
+
+// Sends a local candidate
+// Nil candidate means end of candidates
+func (r *SignalingRequest) sendCandidate(candidate *webrtc.ICECandidate) error {
+	var init *webrtc.ICECandidateInit = nil
+
+	if candidate != nil {
+		c := candidate.ToJSON()
+		init = &c
+	}
+
+	msg, err := newCandidateMessage(r.id, r.streamId, init)
+	if err != nil {
+		return err
+	}
+	return r.client.send(msg)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseSignalingMessage(t *testing.T) {
+	cases := []struct {
+		name   string
+		raw    string
+		valid  bool
+		method string
+		params map[string]string
+		body   string
+	}{
+		{
+			name:   "method only",
+			raw:    "HEARTBEAT",
+			valid:  true,
+			method: "HEARTBEAT",
+			params: map[string]string{},
+		},
+		{
+			name:   "lowercase method and params",
+			raw:    "play\nRequest-ID: req1\nStream-ID:stream1\n",
+			valid:  true,
+			method: "PLAY",
+			params: map[string]string{"request-id": "req1", "stream-id": "stream1"},
+		},
+		{
+			name:   "CRLF line endings",
+			raw:    "CLOSE\r\nRequest-ID: req1\r\n",
+			valid:  true,
+			method: "CLOSE",
+			params: map[string]string{"request-id": "req1"},
+		},
+		{
+			name:   "multi line body",
+			raw:    "OFFER\nRequest-ID: req1\n\nline1\n\nline3",
+			valid:  true,
+			method: "OFFER",
+			params: map[string]string{"request-id": "req1"},
+			body:   "line1\n\nline3",
+		},
+		{
+			name:   "colon in value",
+			raw:    "ERROR\nError-Message: failed: reason",
+			valid:  true,
+			method: "ERROR",
+			params: map[string]string{"error-message": "failed: reason"},
+		},
+		{
+			name:  "empty",
+			raw:   "",
+			valid: false,
+		},
+		{
+			name:  "blank method",
+			raw:   "  \nRequest-ID: req1",
+			valid: false,
+		},
+		{
+			name:  "invalid method",
+			raw:   "{\"method\": \"PLAY\"}",
+			valid: false,
+		},
+		{
+			name:  "param without colon",
+			raw:   "PLAY\nRequest-ID req1",
+			valid: false,
+		},
+		{
+			name:  "param without key",
+			raw:   "PLAY\n: req1",
+			valid: false,
+		},
+	}
+
+	for _, c := range cases {
+		msg, err := parseSignalingMessage(c.raw)
+
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		if msg.method != c.method {
+			t.Errorf("%s: method %q, expected %q", c.name, msg.method, c.method)
+		}
+
+		if len(msg.params) != len(c.params) {
+			t.Errorf("%s: params %v, expected %v", c.name, msg.params, c.params)
+		}
+
+		for key, val := range c.params {
+			if msg.params[key] != val {
+				t.Errorf("%s: param %s = %q, expected %q", c.name, key, msg.params[key], val)
+			}
+		}
+
+		if msg.body != c.body {
+			t.Errorf("%s: body %q, expected %q", c.name, msg.body, c.body)
+		}
+	}
+}
+
+func TestSignalingMessageRoundTrip(t *testing.T) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\n"}
+
+	msg, err := newOfferMessage("req1", "stream1", offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseSignalingMessage(msg.serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeSignalingMessage(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, ok := decoded.(SignalingOffer)
+	if !ok {
+		t.Fatalf("expected SignalingOffer, got %T", decoded)
+	}
+
+	if o.requestId != "req1" || o.streamId != "stream1" || o.description.SDP != offer.SDP {
+		t.Fatalf("unexpected offer: %+v", o)
+	}
+}
+
+func TestDecodeSignalingMessage(t *testing.T) {
+	offerBody := `{"type":"offer","sdp":"v=0"}`
+	answerBody := `{"type":"answer","sdp":"v=0"}`
+
+	cases := []struct {
+		name     string
+		raw      string
+		valid    bool
+		expected interface{}
+	}{
+		{"heartbeat", "HEARTBEAT", true, SignalingHeartbeat{}},
+		{"offer", "OFFER\nRequest-ID: req1\nStream-ID: stream1\n\n" + offerBody, true, SignalingOffer{}},
+		{"offer without request id", "OFFER\n\n" + offerBody, false, nil},
+		{"offer with invalid body", "OFFER\nRequest-ID: req1\n\nnot json", false, nil},
+		{"offer with answer body", "OFFER\nRequest-ID: req1\n\n" + answerBody, false, nil},
+		{"answer", "ANSWER\nRequest-ID: req1\n\n" + answerBody, true, SignalingAnswer{}},
+		{"answer without sdp", "ANSWER\nRequest-ID: req1\n\n{\"type\":\"answer\"}", false, nil},
+		{"candidate", "CANDIDATE\nRequest-ID: req1\n\n{\"candidate\":\"candidate:1 1 udp 1 127.0.0.1 5000 typ host\"}", true, SignalingCandidate{}},
+		{"end of candidates", "CANDIDATE\nRequest-ID: req1\n", true, SignalingCandidate{}},
+		{"candidate without request id", "CANDIDATE\n\n{}", false, nil},
+		{"candidate with invalid body", "CANDIDATE\nRequest-ID: req1\n\n[", false, nil},
+		{"close", "CLOSE\nRequest-ID: req1", true, SignalingClose{}},
+		{"error", "ERROR\nRequest-ID: req1\nError-Code: AUTH_ERROR\nError-Message: Invalid token", true, SignalingErrorMessage{}},
+		{"unknown method", "PUBLISH\nRequest-ID: req1", false, nil},
+	}
+
+	for _, c := range cases {
+		msg, err := parseSignalingMessage(c.raw)
+		if err != nil {
+			t.Errorf("%s: parse error: %v", c.name, err)
+			continue
+		}
+
+		decoded, err := decodeSignalingMessage(msg)
+
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", c.name, decoded)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		switch m := decoded.(type) {
+		case SignalingHeartbeat:
+			_, ok := c.expected.(SignalingHeartbeat)
+			if !ok {
+				t.Errorf("%s: unexpected type %T", c.name, decoded)
+			}
+		case SignalingOffer:
+			if _, ok := c.expected.(SignalingOffer); !ok || m.requestId != "req1" || m.streamId != "stream1" || m.description.SDP != "v=0" {
+				t.Errorf("%s: unexpected result %+v", c.name, decoded)
+			}
+		case SignalingAnswer:
+			if _, ok := c.expected.(SignalingAnswer); !ok || m.requestId != "req1" || m.description.Type != webrtc.SDPTypeAnswer {
+				t.Errorf("%s: unexpected result %+v", c.name, decoded)
+			}
+		case SignalingCandidate:
+			if _, ok := c.expected.(SignalingCandidate); !ok || m.requestId != "req1" {
+				t.Errorf("%s: unexpected result %+v", c.name, decoded)
+			}
+
+			if (c.name == "end of candidates") != (m.candidate == nil) {
+				t.Errorf("%s: unexpected candidate %+v", c.name, m.candidate)
+			}
+		case SignalingClose:
+			if _, ok := c.expected.(SignalingClose); !ok || m.requestId != "req1" {
+				t.Errorf("%s: unexpected result %+v", c.name, decoded)
+			}
+		case SignalingErrorMessage:
+			if _, ok := c.expected.(SignalingErrorMessage); !ok || m.requestId != "req1" || m.code != "AUTH_ERROR" || m.message != "Invalid token" {
+				t.Errorf("%s: unexpected result %+v", c.name, decoded)
+			}
+		default:
+			t.Errorf("%s: unexpected type %T", c.name, decoded)
+		}
+	}
+}
+
+func TestSignalingErrorClassification(t *testing.T) {
+	cases := []struct {
+		code      string
+		retryable bool
+	}{
+		{"AUTH_ERROR", false},
+		{"auth_error", false},
+		{"INVALID_STREAM_ID", false},
+		{"PROTOCOL_ERROR", false},
+		{"FORBIDDEN", false},
+		{"INTERNAL_ERROR", true},
+		{"LIMIT_REACHED", true},
+		{"", true},
+	}
+
+	for _, c := range cases {
+		msg, err := parseSignalingMessage("ERROR\nRequest-ID: req1\nError-Code: " + c.code + "\nError-Message: Test error")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := decodeSignalingMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signalingErr := newSignalingErrorFromMessage(decoded.(SignalingErrorMessage))
+
+		if signalingErr.retryable != c.retryable {
+			t.Errorf("code %q: retryable = %v, expected %v", c.code, signalingErr.retryable, c.retryable)
+		}
+
+		if isFatalSignalingError(signalingErr) == c.retryable || isRetryableSignalingError(signalingErr) != c.retryable {
+			t.Errorf("code %q: inconsistent classification", c.code)
+		}
+
+		if signalingErr.message != "Test error" {
+			t.Errorf("code %q: unexpected message %q", c.code, signalingErr.message)
+		}
+	}
+
+	// Errors produced locally (e.g. a lost connection) are retryable
+	var err error = &SignalingError{message: "signaling connection closed", retryable: true}
+
+	if isFatalSignalingError(err) || !isRetryableSignalingError(err) {
+		t.Error("expected a retryable error")
+	}
+}
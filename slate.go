@@ -0,0 +1,129 @@
+// Placeholder slate
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	child_process_manager "github.com/AgustinSRG/go-child-process-manager"
+)
+
+const DEFAULT_SLATE_TIMEOUT = 3 * time.Second
+
+// Slate options
+type SlateOptions struct {
+	image   string        // Still image to show
+	video   string        // Video clip to loop
+	text    string        // Text to draw over the slate
+	timeout time.Duration // Time without live packets to switch to the slate
+}
+
+// Checks if the slate is enabled
+func (s SlateOptions) enabled() bool {
+	return s.image != "" || s.video != "" || s.text != ""
+}
+
+func createSlateTextFile(port int, text string) string {
+	fileName := "wrtc-slate." + fmt.Sprint(port) + ".txt"
+
+	err := os.WriteFile(fileName, []byte(text), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	return fileName
+}
+
+// Runs the FFmpeg process encoding the slate
+// If it fails, the slate is not available, but the live stream continues
+// The slate is encoded with the same profile as the live stream
+func runSlateProcess(ffmpegBin string, options SlateOptions, encoder EncoderProfile, port int, videoUDP string, debug bool) {
+	args := make([]string, 1)
+
+	args[0] = ffmpegBin
+
+	// Report the progress to stdout
+	args = append(args, "-progress", "pipe:1")
+
+	args = append(args, "-re")
+
+	// INPUT
+	if options.video != "" {
+		args = append(args, "-stream_loop", "-1", "-i", options.video)
+	} else if options.image != "" {
+		args = append(args, "-loop", "1", "-framerate", "25", "-i", options.image)
+	} else {
+		args = append(args, "-f", "lavfi", "-i", "color=c=black:s=1280x720:r=25")
+	}
+
+	// VIDEO OPTIONS
+	args = encoder.appendArgs(args)
+
+	// VIDEO FILTER (scaling and text)
+	filter := encoder.filter()
+
+	if options.text != "" {
+		textFile := createSlateTextFile(port, options.text)
+
+		// Remove the text file when the process ends
+		removeHook := addShutdownHook(func() {
+			os.Remove(textFile)
+		})
+		defer func() {
+			removeHook()
+			os.Remove(textFile)
+		}()
+		filter = joinFilters(filter, "drawtext=textfile="+textFile+":fontcolor=white:fontsize=h/20:x=(w-text_w)/2:y=h-text_h*3:box=1:boxcolor=black@0.5:boxborderw=10")
+	}
+
+	if filter != "" {
+		args = append(args,
+			"-vf", filter,
+		)
+	}
+
+	// VIDEO DESTINATION
+	args = append(args,
+		"-f", "rtp", "rtp://"+videoUDP+"?pkt_size=1200",
+	)
+
+	cmd := exec.Command(ffmpegBin)
+	cmd.Args = args
+
+	if debug {
+		cmd.Stderr = os.Stderr
+		fmt.Println("Running command: " + cmd.String())
+	}
+
+	child_process_manager.ConfigureCommand(cmd)
+
+	progressReader, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Println("Error: slate ffmpeg program failed: " + err.Error())
+		return
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		fmt.Println("Error: slate ffmpeg program failed: " + err.Error())
+		return
+	}
+
+	child_process_manager.AddChildProcess(cmd.Process)
+
+	progress := registerFFmpegProgress("slate", debug)
+
+	progress.read(progressReader)
+
+	err = cmd.Wait()
+
+	progress.end()
+
+	if err != nil {
+		fmt.Println("Error: slate ffmpeg program failed: " + err.Error())
+	}
+}
@@ -0,0 +1,163 @@
+// Track switcher (live feed / slate)
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	SWITCHER_INPUT_LIVE  = 0
+	SWITCHER_INPUT_SLATE = 1
+)
+
+const SWITCHER_CHECK_INTERVAL = 500 * time.Millisecond
+
+// Writes to the destination track the packets of the selected input
+// Switching between inputs is only done at keyframes
+type TrackSwitcher struct {
+	lock sync.Mutex
+
+	track *webrtc.TrackLocalStaticRTP
+
+	slateEnabled bool
+	stallTimeout time.Duration
+
+	active   int // Input being written
+	selected int // Input we want to write
+
+	lastLivePacket time.Time
+
+	rewriter *RTPRewriter
+
+	recorder *Recorder
+}
+
+// Creates new track switcher
+func NewTrackSwitcher(track *webrtc.TrackLocalStaticRTP, slateEnabled bool, stallTimeout time.Duration, recorder *Recorder) *TrackSwitcher {
+	return &TrackSwitcher{
+		lock:           sync.Mutex{},
+		track:          track,
+		slateEnabled:   slateEnabled,
+		stallTimeout:   stallTimeout,
+		active:         SWITCHER_INPUT_LIVE,
+		selected:       SWITCHER_INPUT_LIVE,
+		lastLivePacket: time.Now(),
+		rewriter:       NewRTPRewriter(90000),
+		recorder:       recorder,
+	}
+}
+
+// Writes a packet received from an input
+func (s *TrackSwitcher) write(input int, packet *rtp.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if input == SWITCHER_INPUT_LIVE {
+		s.lastLivePacket = time.Now()
+		s.selected = SWITCHER_INPUT_LIVE
+	}
+
+	if input != s.active {
+		if input != s.selected || !isVP8KeyframeStart(packet.Payload) {
+			return nil // Wait for a keyframe to switch
+		}
+
+		s.active = input
+		s.rewriter.reset()
+
+		if input == SWITCHER_INPUT_LIVE {
+			fmt.Println("[DESTINATION] Switched to live feed")
+		} else {
+			fmt.Println("[DESTINATION] Switched to slate")
+		}
+	}
+
+	s.rewriter.rewrite(packet)
+
+	s.recorder.writeRTP(packet)
+
+	return s.track.WriteRTP(packet)
+}
+
+// Checks for source stalls, selecting the slate if the live feed stops
+// Runs until the process ends
+func (s *TrackSwitcher) run() {
+	if !s.slateEnabled {
+		return
+	}
+
+	ticker := time.NewTicker(SWITCHER_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.lock.Lock()
+
+		if s.selected == SWITCHER_INPUT_LIVE && time.Since(s.lastLivePacket) > s.stallTimeout {
+			fmt.Println("[DESTINATION] Source stalled. Switching to slate...")
+			s.selected = SWITCHER_INPUT_SLATE
+		}
+
+		s.lock.Unlock()
+	}
+}
+
+// Checks if a VP8 RTP payload is the start of a keyframe
+func isVP8KeyframeStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	hasExtension := payload[0]&0x80 != 0
+	isStart := payload[0]&0x10 != 0
+	partitionId := payload[0] & 0x07
+
+	if !isStart || partitionId != 0 {
+		return false
+	}
+
+	i := 1
+
+	if hasExtension {
+		if len(payload) <= i {
+			return false
+		}
+
+		ext := payload[i]
+		i++
+
+		if ext&0x80 != 0 {
+			// Picture ID
+			if len(payload) <= i {
+				return false
+			}
+
+			if payload[i]&0x80 != 0 {
+				i += 2
+			} else {
+				i++
+			}
+		}
+
+		if ext&0x40 != 0 {
+			// TL0PICIDX
+			i++
+		}
+
+		if ext&0x30 != 0 {
+			// TID / KEYIDX
+			i++
+		}
+	}
+
+	if len(payload) <= i {
+		return false
+	}
+
+	return payload[i]&0x01 == 0
+}
@@ -0,0 +1,89 @@
+// Periodic thumbnails
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const DEFAULT_THUMBNAIL_INTERVAL = 10
+const DEFAULT_THUMBNAIL_FORMAT = "jpg"
+const DEFAULT_THUMBNAIL_WIDTH = 320
+
+// Thumbnail options
+type ThumbnailOptions struct {
+	dir      string // Directory to write the thumbnails
+	interval int    // Interval (seconds)
+	format   string // Image format (jpg, png, webp)
+	width    int    // Width (-1 to keep aspect ratio)
+	height   int    // Height (-1 to keep aspect ratio)
+	source   bool   // True to also generate thumbnails of the unfiltered source
+}
+
+// Checks if the thumbnails are enabled
+func (o ThumbnailOptions) enabled() bool {
+	return o.dir != ""
+}
+
+// Checks if the format is valid
+func isValidThumbnailFormat(format string) bool {
+	return format == "jpg" || format == "png" || format == "webp"
+}
+
+// Returns the file name of a thumbnail
+// kind - "output" or "source"
+func (o ThumbnailOptions) fileName(kind string) string {
+	return kind + "." + o.format
+}
+
+// Prepares the directory and returns the encoder outputs
+func (o ThumbnailOptions) prepareOutputs() ([]EncoderOutput, error) {
+	err := os.MkdirAll(o.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	width := fmt.Sprint(o.width)
+	height := fmt.Sprint(o.height)
+
+	// Keep aspect ratio with even dimensions
+	if o.width == -1 {
+		width = "-2"
+	}
+
+	if o.height == -1 {
+		height = "-2"
+	}
+
+	filter := "fps=1/" + fmt.Sprint(o.interval) + ",scale=" + width + ":" + height
+
+	outputs := []EncoderOutput{
+		{kind: ENCODER_OUTPUT_IMAGE, url: filepath.Join(o.dir, o.fileName("output")), filter: filter},
+	}
+
+	if o.source {
+		outputs = append(outputs, EncoderOutput{kind: ENCODER_OUTPUT_IMAGE, url: filepath.Join(o.dir, o.fileName("source")), filter: filter, unfiltered: true})
+	}
+
+	return outputs, nil
+}
+
+// Registers the HTTP handlers to serve the thumbnails
+func registerThumbnailHandlers(o ThumbnailOptions) {
+	serveThumbnail := func(kind string) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFile(w, r, filepath.Join(o.dir, o.fileName(kind)))
+		}
+	}
+
+	httpMux.HandleFunc("GET /thumbnails/"+o.fileName("output"), serveThumbnail("output"))
+
+	if o.source {
+		httpMux.HandleFunc("GET /thumbnails/"+o.fileName("source"), serveThumbnail("source"))
+	}
+}
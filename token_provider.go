@@ -0,0 +1,211 @@
+// External token provider (HTTP endpoint or local command)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Max time to wait for the token provider
+const TOKEN_PROVIDER_TIMEOUT = 10 * time.Second
+
+// Tokens are requested again this time before they expire
+const TOKEN_PROVIDER_EXPIRATION_MARGIN = 10 * time.Second
+
+// Request sent to the token provider
+type TokenProviderRequest struct {
+	Role     string `json:"role"`
+	StreamId string `json:"stream_id"`
+}
+
+// Response of the token provider (JSON)
+// The provider can also respond with the token as plain text
+type TokenProviderResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"` // Seconds
+	ExpiresAt int64  `json:"expires_at"` // Unix timestamp (seconds)
+}
+
+// Cached token
+type CachedToken struct {
+	token     string
+	expiresAt time.Time // Zero if unknown (not cached)
+}
+
+// Token provider
+type TokenProvider struct {
+	lock sync.Mutex
+
+	url     string // HTTP endpoint
+	command string // Local command
+
+	cache map[string]CachedToken
+}
+
+// Creates a token provider calling an HTTP endpoint
+func NewHTTPTokenProvider(url string) *TokenProvider {
+	return &TokenProvider{
+		lock:  sync.Mutex{},
+		url:   url,
+		cache: make(map[string]CachedToken),
+	}
+}
+
+// Creates a token provider running a local command
+func NewCommandTokenProvider(command string) *TokenProvider {
+	return &TokenProvider{
+		lock:    sync.Mutex{},
+		command: command,
+		cache:   make(map[string]CachedToken),
+	}
+}
+
+// Gets a token for a role and stream, using the cached one if it did not expire
+func (p *TokenProvider) getToken(role string, streamId string) (string, error) {
+	key := role + ":" + streamId
+
+	p.lock.Lock()
+	cached, ok := p.cache[key]
+	p.lock.Unlock()
+
+	if ok && time.Now().Add(TOKEN_PROVIDER_EXPIRATION_MARGIN).Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	var raw []byte
+	var err error
+
+	if p.url != "" {
+		raw, err = p.requestHTTP(role, streamId)
+	} else {
+		raw, err = p.runCommand(role, streamId)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	token, err := parseTokenProviderResponse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if !token.expiresAt.IsZero() {
+		p.lock.Lock()
+		p.cache[key] = token
+		p.lock.Unlock()
+	}
+
+	return token.token, nil
+}
+
+// Requests a token to the HTTP endpoint
+func (p *TokenProvider) requestHTTP(role string, streamId string) ([]byte, error) {
+	body, err := json.Marshal(TokenProviderRequest{
+		Role:     role,
+		StreamId: streamId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: TOKEN_PROVIDER_TIMEOUT,
+	}
+
+	res, err := client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token provider responded with status %d", res.StatusCode)
+	}
+
+	return resBody, nil
+}
+
+// Runs the command to get a token
+// The command is split on whitespace (no shell, no quoting)
+// The role and the stream ID are appended as arguments,
+// and set as the TOKEN_ROLE and TOKEN_STREAM_ID environment variables
+func (p *TokenProvider) runCommand(role string, streamId string) ([]byte, error) {
+	args := strings.Fields(p.command)
+
+	if len(args) == 0 {
+		return nil, errors.New("empty token provider command")
+	}
+
+	args = append(args, role, streamId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), TOKEN_PROVIDER_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "TOKEN_ROLE="+role, "TOKEN_STREAM_ID="+streamId)
+	cmd.Stderr = os.Stderr
+
+	return cmd.Output()
+}
+
+// Parses the response of the token provider (JSON or plain text)
+// If the expiration is not in the response, it is taken from the token (if it is a JWT)
+func parseTokenProviderResponse(raw []byte) (CachedToken, error) {
+	result := CachedToken{}
+
+	trimmed := strings.TrimSpace(string(raw))
+
+	if strings.HasPrefix(trimmed, "{") {
+		res := TokenProviderResponse{}
+
+		err := json.Unmarshal([]byte(trimmed), &res)
+		if err != nil {
+			return result, errors.New("invalid token provider response: " + err.Error())
+		}
+
+		result.token = res.Token
+
+		if res.ExpiresAt > 0 {
+			result.expiresAt = time.Unix(res.ExpiresAt, 0)
+		} else if res.ExpiresIn > 0 {
+			result.expiresAt = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+		}
+	} else {
+		result.token = trimmed
+	}
+
+	if result.token == "" {
+		return result, errors.New("token provider returned an empty token")
+	}
+
+	if result.expiresAt.IsZero() {
+		claims := jwt.MapClaims{}
+
+		if _, _, err := jwt.NewParser().ParseUnverified(result.token, claims); err == nil {
+			if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+				result.expiresAt = exp.Time
+			}
+		}
+	}
+
+	return result, nil
+}
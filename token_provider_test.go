@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Starts a stub token provider, responding with the given function
+// Returns the server and the number of requests received
+func startStubTokenProvider(t *testing.T, respond func(req TokenProviderRequest) (string, string)) (*httptest.Server, *int32) {
+	t.Helper()
+
+	requests := new(int32)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := TokenProviderRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		contentType, body := respond(req)
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestTokenProviderJSON(t *testing.T) {
+	server, requests := startStubTokenProvider(t, func(req TokenProviderRequest) (string, string) {
+		body, _ := json.Marshal(TokenProviderResponse{
+			Token:     "token-" + req.Role + "-" + req.StreamId,
+			ExpiresIn: 3600,
+		})
+		return "application/json", string(body)
+	})
+
+	provider := NewHTTPTokenProvider(server.URL)
+
+	for i := 0; i < 3; i++ {
+		token, err := provider.getToken(AUTH_ROLE_PLAY, "stream1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "token-play-stream1" {
+			t.Fatalf("unexpected token: %s", token)
+		}
+	}
+
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected 1 request (cached), got %d", n)
+	}
+
+	// Different role and stream are cached separately
+	token, err := provider.getToken(AUTH_ROLE_PUBLISH, "stream2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "token-publish-stream2" {
+		t.Fatalf("unexpected token: %s", token)
+	}
+
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestTokenProviderPlainText(t *testing.T) {
+	server, requests := startStubTokenProvider(t, func(req TokenProviderRequest) (string, string) {
+		return "text/plain", "  opaque-token\n"
+	})
+
+	provider := NewHTTPTokenProvider(server.URL)
+
+	for i := 0; i < 2; i++ {
+		token, err := provider.getToken(AUTH_ROLE_PLAY, "stream1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "opaque-token" {
+			t.Fatalf("unexpected token: %q", token)
+		}
+	}
+
+	// Unknown expiration, not cached
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 requests (not cached), got %d", n)
+	}
+}
+
+func TestTokenProviderJWTExpiration(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "stream_play",
+		"exp": exp,
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, requests := startStubTokenProvider(t, func(req TokenProviderRequest) (string, string) {
+		return "text/plain", signed
+	})
+
+	provider := NewHTTPTokenProvider(server.URL)
+
+	for i := 0; i < 2; i++ {
+		token, err := provider.getToken(AUTH_ROLE_PLAY, "stream1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != signed {
+			t.Fatalf("unexpected token: %s", token)
+		}
+	}
+
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected 1 request (cached until exp), got %d", n)
+	}
+
+	if cached := provider.cache[AUTH_ROLE_PLAY+":stream1"]; cached.expiresAt.Unix() != exp {
+		t.Fatalf("expected expiration %d from the exp claim, got %d", exp, cached.expiresAt.Unix())
+	}
+}
+
+func TestTokenProviderCacheExpiry(t *testing.T) {
+	counter := new(int32)
+
+	server, requests := startStubTokenProvider(t, func(req TokenProviderRequest) (string, string) {
+		n := atomic.AddInt32(counter, 1)
+
+		// Expires within the margin, so it must be requested again
+		body, _ := json.Marshal(TokenProviderResponse{
+			Token:     "token-" + string(rune('0'+n)),
+			ExpiresAt: time.Now().Add(TOKEN_PROVIDER_EXPIRATION_MARGIN / 2).Unix(),
+		})
+		return "application/json", string(body)
+	})
+
+	provider := NewHTTPTokenProvider(server.URL)
+
+	first, err := provider.getToken(AUTH_ROLE_PLAY, "stream1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := provider.getToken(AUTH_ROLE_PLAY, "stream1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Fatalf("expected a new token, got %s twice", first)
+	}
+
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestTokenProviderErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := NewHTTPTokenProvider(server.URL).getToken(AUTH_ROLE_PLAY, "stream1")
+	if err == nil {
+		t.Fatal("expected an error for a non 200 status")
+	}
+
+	emptyServer, _ := startStubTokenProvider(t, func(req TokenProviderRequest) (string, string) {
+		return "application/json", `{"token": ""}`
+	})
+
+	_, err = NewHTTPTokenProvider(emptyServer.URL).getToken(AUTH_ROLE_PLAY, "stream1")
+	if err == nil {
+		t.Fatal("expected an error for an empty token")
+	}
+}
@@ -3,31 +3,90 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"net/url"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
 type ProcessOptions struct {
-	port                 int
-	debug                bool
-	ffmpeg               string
-	videoFilter          string
-	authTokenSource      string
-	authTokenDestination string
+	port             int
+	debug            bool
+	ffmpeg           string
+	videoFilter      string
+	slate            SlateOptions
+	sourceTimeout    time.Duration
+	failback         bool
+	failbackInterval time.Duration
+	loop             bool
+	preview          *PreviewServer
+	outputs          []EncoderOutput
+	sourceRecorder   *Recorder
+	outputRecorder   *Recorder
+	signalingTimeout time.Duration
+	auth             *AuthOptions
+	websocket        *WebsocketOptions
+	encoder          EncoderProfile
 }
 
-func runProcess(source url.URL, sourceStreamId string, destination url.URL, destinationStreamId string, options ProcessOptions) {
-	// Mutex
-	lock := sync.Mutex{}
+// Gets the options of the publishing process
+func (o ProcessOptions) publishOptions() PublishOptions {
+	return PublishOptions{
+		debug:            o.debug,
+		port:             o.port,
+		ffmpeg:           o.ffmpeg,
+		videoFilter:      o.videoFilter,
+		slate:            o.slate,
+		preview:          o.preview,
+		outputs:          o.outputs,
+		recorder:         o.outputRecorder,
+		signalingTimeout: o.signalingTimeout,
+		auth:             o.auth,
+		websocket:        o.websocket,
+		encoder:          o.encoder,
+	}
+}
+
+const SOURCE_RECONNECT_DELAY = 5 * time.Second
+
+func runProcess(sources []StreamEndpoint, destination StreamEndpoint, options ProcessOptions) {
+	// The publishing process is started once and kept
+	// for the rest of the process, even if the source reconnects
+	publishLock := sync.Mutex{}
+	publishStarted := false
+
+	startPublish := func() {
+		publishLock.Lock()
+		defer publishLock.Unlock()
+
+		if publishStarted {
+			return
+		}
+
+		publishStarted = true
+
+		// Create SDP file
+		sdpFile := createForwardSDPFile(options.port)
+
+		// Run publishing process
+		go runPublish(EncoderInput{source: sdpFile, sdp: true}, destination, options.publishOptions())
+	}
+
+	if options.slate.enabled() {
+		// Publish the slate while the source is not available
+		startPublish()
+	}
+
+	runSourceFailover(sources, startPublish, options)
+
+	killProcess()
+}
 
+// Creates the WebRTC API to receive the source track
+func createSourceAPI() *webrtc.API {
 	m := &webrtc.MediaEngine{}
 
 	// Setup the codecs you want to use.
@@ -55,252 +114,164 @@ func runProcess(source url.URL, sourceStreamId string, destination url.URL, dest
 	}
 
 	// Create the API object with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(createSettingEngine(WEBRTC_LEG_SOURCE)))
+}
 
-	// Connect to websocket
-	if options.debug {
-		fmt.Println("Connecting to " + source.String())
-	}
-	c, _, err := websocket.DefaultDialer.Dial(source.String(), nil)
-	if err != nil {
-		fmt.Println("Error: " + err.Error())
+// Plays the source stream until the connection is closed or fails
+func runSourceSession(session *SourceSession, startPublish func(), options ProcessOptions) {
+	switch session.source.protocol {
+	case STREAM_PROTOCOL_WHEP:
+		runSourceSessionWHEP(session, startPublish, options)
+	default:
+		runSourceSessionWebRTCCDN(session, startPublish, options)
 	}
-	defer c.Close()
-
-	go func() {
-		for {
-			time.Sleep(20 * time.Second)
-
-			// Send hearbeat message
-			heartbeatMessage := SignalingMessage{
-				method: "HEARTBEAT",
-				params: nil,
-				body:   "",
-			}
-
-			lock.Lock()
-			sendErr := c.WriteMessage(websocket.TextMessage, []byte(heartbeatMessage.serialize()))
-			lock.Unlock()
+}
 
-			if options.debug {
-				fmt.Println("[SOURCE] >>>\n" + string(heartbeatMessage.serialize()))
-			}
+// Handles the video track received from the source
+func onSourceTrack(peerConnection *webrtc.PeerConnection, remoteTrack *webrtc.TrackRemote, session *SourceSession, startPublish func(), options ProcessOptions) {
+	// Replace the previous track, if any
+	session.setTrack(remoteTrack)
 
-			if sendErr != nil {
+	// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+	go func() {
+		ticker := time.NewTicker(time.Second * 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed || !session.isCurrentTrack(remoteTrack) {
 				return
 			}
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpErr != nil {
+				fmt.Println(rtcpErr)
+			}
 		}
 	}()
 
+	// Forward track to RTP for FFmpeg to process
+	go forwardTrack(remoteTrack, options.port, session, options.sourceRecorder)
+
+	// Run publishing process
+	if session.isActive() {
+		startPublish()
+	}
+}
+
+// Plays the source stream from a webrtc-cdn node
+func runSourceSessionWebRTCCDN(session *SourceSession, startPublish func(), options ProcessOptions) {
+	defer close(session.ended)
+
+	api := createSourceAPI()
+
+	// Connect to websocket (shared with other sessions to the same node)
+	client, err := getSignalingClient(session.source, options.websocket, options.debug)
+	if err != nil {
+		session.onSignalingError(err)
+		return
+	}
+	defer client.release()
+
+	// Get a fresh token for every session
+	authToken, err := options.auth.getToken(AUTH_ROLE_PLAY, session.source.streamId)
+	if err != nil {
+		session.onSignalingError(&SignalingError{message: "could not get the authentication token: " + err.Error(), retryable: true})
+		return
+	}
+
 	// Send play message
-	pubMsg := SignalingMessage{
-		method: "PLAY",
-		params: make(map[string]string),
-		body:   "",
+	req, err := client.play(session.source.streamId, authToken)
+	if err != nil {
+		session.onSignalingError(err)
+		return
 	}
-	pubMsg.params["Request-ID"] = "play01"
-	pubMsg.params["Stream-ID"] = sourceStreamId
-	if options.authTokenSource != "" {
-		pubMsg.params["Auth"] = options.authTokenSource
+	defer req.close()
+
+	// Ends the session (closing the request ends the message loop)
+	session.setCloseFunc(req.close)
+
+	offer, err := req.waitOffer(options.signalingTimeout)
+	if err != nil {
+		session.onSignalingError(err)
+		return
 	}
-	c.WriteMessage(websocket.TextMessage, []byte(pubMsg.serialize()))
 
-	if options.debug {
-		fmt.Println("[SOURCE] >>>\n" + string(pubMsg.serialize()))
+	// Create peer connection
+	peerConnectionConfig := loadWebRTCConfig(WEBRTC_LEG_SOURCE) // Load config
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		fmt.Println("[SOURCE] Error: " + err.Error())
+		return
 	}
+	defer peerConnection.Close()
 
-	receivedOffer := false
-	receivedVideoTrack := false
-	closed := false
+	negotiator := NewSignalingNegotiator(peerConnection, req, "[SOURCE]")
 
-	var peerConnection *webrtc.PeerConnection = nil
+	// Track listener
+	// New video tracks (renegotiation) replace the previous one
+	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if remoteTrack.Kind() != webrtc.RTPCodecTypeVideo {
+			return // Not a video track
+		}
 
-	// Read websocket messages
-	for {
-		if closed {
-			return
+		if options.debug {
+			fmt.Println("[SOURCE] Received video track: " + remoteTrack.ID())
+		}
+
+		onSourceTrack(peerConnection, remoteTrack, session, startPublish, options)
+	})
+
+	// ICE Candidate handler
+	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
+		err := req.sendCandidate(i)
+		if err != nil && options.debug {
+			fmt.Println("[SOURCE] Error: " + err.Error())
 		}
-		func() {
-			_, message, err := c.ReadMessage()
+	})
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			fmt.Println("[SOURCE] WebRTC: Disconnected")
+			req.close()
+		} else if state == webrtc.PeerConnectionStateDisconnected {
+			fmt.Println("[SOURCE] WebRTC: Connection interrupted")
+		} else if state == webrtc.PeerConnectionStateConnected {
+			fmt.Println("[SOURCE] WebRTC: Connected")
+		}
+
+		negotiator.onConnectionStateChange(state)
+	})
+
+	// Set remote description and send the answer
+	err = negotiator.onOffer(offer.description)
+	if err != nil {
+		fmt.Println("[SOURCE] Error: " + err.Error())
+		return
+	}
+
+	// Handle signaling messages until the session ends
+	for msg := range req.messages {
+		switch m := msg.(type) {
+		case SignalingCandidate:
+			err := negotiator.onCandidate(m)
 			if err != nil {
-				closed = true
-				killProcess()
-				return // Closed
+				fmt.Println("[SOURCE] Error: " + err.Error())
 			}
-
-			if options.debug {
-				fmt.Println("[SOURCE] <<<\n" + string(message))
+		case SignalingOffer:
+			// Renegotiation
+			err := negotiator.onOffer(m.description)
+			if err != nil {
+				fmt.Println("[SOURCE] Error: Renegotiation failed: " + err.Error())
+				return
 			}
-
-			msg := parseSignalingMessage(string(message))
-
-			lock.Lock()
-			defer lock.Unlock()
-
-			if msg.method == "ERROR" {
-				fmt.Println("Error: " + msg.params["error-message"])
-				killProcess()
-			} else if msg.method == "OFFER" {
-				if !receivedOffer {
-					receivedOffer = true
-
-					// Create peer connection
-					peerConnectionConfig := loadWebRTCConfig() // Load config
-					peerConnection, err = api.NewPeerConnection(peerConnectionConfig)
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-						return
-					}
-
-					// Track listener
-					peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-						lock.Lock()
-						defer lock.Unlock()
-
-						if receivedVideoTrack {
-							return // Already received the track
-						}
-
-						if remoteTrack.Kind() != webrtc.RTPCodecTypeVideo {
-							return // Not a video track
-						}
-
-						receivedVideoTrack = true
-
-						// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-						go func() {
-							ticker := time.NewTicker(time.Second * 2)
-							for range ticker.C {
-								if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpErr != nil {
-									fmt.Println(rtcpErr)
-								}
-							}
-						}()
-
-						// Create SDP file
-						sdpFile := createForwardSDPFile(options.port)
-
-						// Forward track to RTP for FFmpeg to process
-						go forwardTrack(remoteTrack, options.port)
-
-						// Run publishing process
-						go runPublish(sdpFile, destination, destinationStreamId, PublishOptions{
-							debug:       options.debug,
-							ffmpeg:      options.ffmpeg,
-							authToken:   options.authTokenDestination,
-							videoFilter: options.videoFilter,
-						})
-					})
-
-					// ICE Candidate handler
-					peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-						lock.Lock()
-						defer lock.Unlock()
-
-						candidateMsg := SignalingMessage{
-							method: "CANDIDATE",
-							params: make(map[string]string),
-							body:   "",
-						}
-						candidateMsg.params["Request-ID"] = "play01"
-						candidateMsg.params["Stream-ID"] = sourceStreamId
-						if i != nil {
-							b, e := json.Marshal(i.ToJSON())
-							if e != nil {
-								fmt.Println("Error: " + e.Error())
-							} else {
-								candidateMsg.body = string(b)
-							}
-						}
-
-						c.WriteMessage(websocket.TextMessage, []byte(candidateMsg.serialize()))
-						if options.debug {
-							fmt.Println("[SOURCE] >>>\n" + string(candidateMsg.serialize()))
-						}
-					})
-
-					peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-						lock.Lock()
-						defer lock.Unlock()
-
-						if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-							fmt.Println("[SOURCE] WebRTC: Disconnected")
-							killProcess()
-						} else if state == webrtc.PeerConnectionStateConnected {
-							fmt.Println("[SOURCE] WebRTC: Connected")
-						}
-					})
-
-					// Set remote rescription
-
-					sd := webrtc.SessionDescription{}
-
-					err := json.Unmarshal([]byte(msg.body), &sd)
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					err = peerConnection.SetRemoteDescription(sd)
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					// Generate answer
-					answer, err := peerConnection.CreateAnswer(nil)
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					// Sets the LocalDescription, and starts our UDP listeners
-					err = peerConnection.SetLocalDescription(answer)
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					// Send ANSWER to the client
-
-					answerJSON, e := json.Marshal(answer)
-
-					if e != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					answerMsg := SignalingMessage{
-						method: "ANSWER",
-						params: make(map[string]string),
-						body:   string(answerJSON),
-					}
-					answerMsg.params["Request-ID"] = "play01"
-					answerMsg.params["Stream-ID"] = sourceStreamId
-
-					c.WriteMessage(websocket.TextMessage, []byte(answerMsg.serialize()))
-
-					if options.debug {
-						fmt.Println(">>>\n" + string(answerMsg.serialize()))
-					}
-				}
-			} else if msg.method == "CANDIDATE" {
-				if receivedOffer && msg.body != "" {
-					candidate := webrtc.ICECandidateInit{}
-
-					err := json.Unmarshal([]byte(msg.body), &candidate)
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					err = peerConnection.AddICECandidate(candidate)
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-				}
-			} else if msg.method == "CLOSE" {
-				fmt.Println("[SOURCE] Connection closed by remote host.")
-				killProcess()
+		case SignalingAnswer:
+			err := negotiator.onAnswer(m.description)
+			if err != nil {
+				fmt.Println("[SOURCE] Error: " + err.Error())
 			}
-		}()
+		case SignalingClose:
+			fmt.Println("[SOURCE] Connection closed by remote host.")
+			return
+		case SignalingErrorMessage:
+			session.onSignalingError(newSignalingErrorFromMessage(m))
+			return
+		}
 	}
 }
@@ -0,0 +1,301 @@
+// Minimal WebM / Matroska writer (single VP8 video track)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// EBML element IDs
+const (
+	EBML_ID_HEADER                = 0x1A45DFA3
+	EBML_ID_VERSION               = 0x4286
+	EBML_ID_READ_VERSION          = 0x42F7
+	EBML_ID_MAX_ID_LENGTH         = 0x42F2
+	EBML_ID_MAX_SIZE_LENGTH       = 0x42F3
+	EBML_ID_DOC_TYPE              = 0x4282
+	EBML_ID_DOC_TYPE_VERSION      = 0x4287
+	EBML_ID_DOC_TYPE_READ_VERSION = 0x4285
+	EBML_ID_SEGMENT               = 0x18538067
+	EBML_ID_INFO                  = 0x1549A966
+	EBML_ID_TIMECODE_SCALE        = 0x2AD7B1
+	EBML_ID_MUXING_APP            = 0x4D80
+	EBML_ID_WRITING_APP           = 0x5741
+	EBML_ID_DURATION              = 0x4489
+	EBML_ID_TRACKS                = 0x1654AE6B
+	EBML_ID_TRACK_ENTRY           = 0xAE
+	EBML_ID_TRACK_NUMBER          = 0xD7
+	EBML_ID_TRACK_UID             = 0x73C5
+	EBML_ID_TRACK_TYPE            = 0x83
+	EBML_ID_CODEC_ID              = 0x86
+	EBML_ID_VIDEO                 = 0xE0
+	EBML_ID_PIXEL_WIDTH           = 0xB0
+	EBML_ID_PIXEL_HEIGHT          = 0xBA
+	EBML_ID_CLUSTER               = 0x1F43B675
+	EBML_ID_TIMECODE              = 0xE7
+	EBML_ID_SIMPLE_BLOCK          = 0xA3
+)
+
+// Max duration of a cluster (milliseconds)
+// Block timecodes are relative to the cluster, stored as int16
+const WEBM_MAX_CLUSTER_DURATION = 5000
+
+// Writes the ID of an element
+func ebmlWriteId(buf *bytes.Buffer, id uint32) {
+	switch {
+	case id >= 0x1000000:
+		buf.Write([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+	case id >= 0x10000:
+		buf.Write([]byte{byte(id >> 16), byte(id >> 8), byte(id)})
+	case id >= 0x100:
+		buf.Write([]byte{byte(id >> 8), byte(id)})
+	default:
+		buf.WriteByte(byte(id))
+	}
+}
+
+// Writes the size of an element (variable length integer)
+func ebmlWriteSize(buf *bytes.Buffer, size uint64) {
+	length := 1
+
+	for length < 8 && size >= (uint64(1)<<(7*length))-1 {
+		length++
+	}
+
+	b := make([]byte, length)
+
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(size)
+		size >>= 8
+	}
+
+	b[0] |= byte(0x80 >> (length - 1))
+
+	buf.Write(b)
+}
+
+func ebmlWriteElement(buf *bytes.Buffer, id uint32, data []byte) {
+	ebmlWriteId(buf, id)
+	ebmlWriteSize(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func ebmlWriteUint(buf *bytes.Buffer, id uint32, val uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, val)
+
+	i := 0
+	for i < 7 && b[i] == 0 {
+		i++
+	}
+
+	ebmlWriteElement(buf, id, b[i:])
+}
+
+func ebmlWriteString(buf *bytes.Buffer, id uint32, val string) {
+	ebmlWriteElement(buf, id, []byte(val))
+}
+
+func ebmlWriteFloat(buf *bytes.Buffer, id uint32, val float64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(val))
+	ebmlWriteElement(buf, id, b)
+}
+
+// WebM file writer
+type WebMWriter struct {
+	file *os.File
+
+	size int64 // Bytes written
+
+	segmentDataOffset int64 // Offset of the segment data
+	durationOffset    int64 // Offset of the duration value
+
+	cluster         *bytes.Buffer
+	clusterTimecode int64
+
+	lastTimecode int64
+}
+
+// Creates a WebM (or Matroska) file, writing the headers
+// Fails if the file already exists
+func NewWebMWriter(fileName string, matroska bool, width int, height int) (*WebMWriter, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WebMWriter{
+		file: file,
+	}
+
+	docType := "webm"
+
+	if matroska {
+		docType = "matroska"
+	}
+
+	// EBML header
+	header := &bytes.Buffer{}
+	ebmlWriteUint(header, EBML_ID_VERSION, 1)
+	ebmlWriteUint(header, EBML_ID_READ_VERSION, 1)
+	ebmlWriteUint(header, EBML_ID_MAX_ID_LENGTH, 4)
+	ebmlWriteUint(header, EBML_ID_MAX_SIZE_LENGTH, 8)
+	ebmlWriteString(header, EBML_ID_DOC_TYPE, docType)
+	ebmlWriteUint(header, EBML_ID_DOC_TYPE_VERSION, 4)
+	ebmlWriteUint(header, EBML_ID_DOC_TYPE_READ_VERSION, 2)
+
+	buf := &bytes.Buffer{}
+	ebmlWriteElement(buf, EBML_ID_HEADER, header.Bytes())
+
+	// Segment, with unknown size (set when the file is closed)
+	ebmlWriteId(buf, EBML_ID_SEGMENT)
+	buf.Write([]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+
+	w.segmentDataOffset = int64(buf.Len())
+
+	// Info
+	info := &bytes.Buffer{}
+	ebmlWriteUint(info, EBML_ID_TIMECODE_SCALE, 1000000) // Milliseconds
+	ebmlWriteString(info, EBML_ID_MUXING_APP, "webrtc-video-filter")
+	ebmlWriteString(info, EBML_ID_WRITING_APP, "webrtc-video-filter")
+	durationOffsetInInfo := int64(info.Len()) + 3 // ID (2 bytes) + Size (1 byte)
+	ebmlWriteFloat(info, EBML_ID_DURATION, 0)
+
+	ebmlWriteId(buf, EBML_ID_INFO)
+	ebmlWriteSize(buf, uint64(info.Len()))
+	w.durationOffset = int64(buf.Len()) + durationOffsetInInfo
+	buf.Write(info.Bytes())
+
+	// Tracks
+	video := &bytes.Buffer{}
+	ebmlWriteUint(video, EBML_ID_PIXEL_WIDTH, uint64(width))
+	ebmlWriteUint(video, EBML_ID_PIXEL_HEIGHT, uint64(height))
+
+	trackEntry := &bytes.Buffer{}
+	ebmlWriteUint(trackEntry, EBML_ID_TRACK_NUMBER, 1)
+	ebmlWriteUint(trackEntry, EBML_ID_TRACK_UID, 1)
+	ebmlWriteUint(trackEntry, EBML_ID_TRACK_TYPE, 1) // Video
+	ebmlWriteString(trackEntry, EBML_ID_CODEC_ID, "V_VP8")
+	ebmlWriteElement(trackEntry, EBML_ID_VIDEO, video.Bytes())
+
+	tracks := &bytes.Buffer{}
+	ebmlWriteElement(tracks, EBML_ID_TRACK_ENTRY, trackEntry.Bytes())
+
+	ebmlWriteElement(buf, EBML_ID_TRACKS, tracks.Bytes())
+
+	err = w.write(buf.Bytes())
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *WebMWriter) write(b []byte) error {
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return err
+}
+
+// Returns the size of the file
+func (w *WebMWriter) getSize() int64 {
+	size := w.size
+
+	if w.cluster != nil {
+		size += int64(w.cluster.Len())
+	}
+
+	return size
+}
+
+// Returns the duration of the file (milliseconds)
+func (w *WebMWriter) getDuration() int64 {
+	return w.lastTimecode
+}
+
+// Writes the current cluster to the file
+func (w *WebMWriter) flushCluster() error {
+	if w.cluster == nil {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	ebmlWriteElement(buf, EBML_ID_CLUSTER, w.cluster.Bytes())
+
+	w.cluster = nil
+
+	return w.write(buf.Bytes())
+}
+
+// Writes a frame
+// timecode - Frame timecode (milliseconds)
+func (w *WebMWriter) writeFrame(data []byte, keyframe bool, timecode int64) error {
+	if w.cluster != nil && (keyframe || timecode-w.clusterTimecode >= WEBM_MAX_CLUSTER_DURATION || timecode < w.clusterTimecode) {
+		err := w.flushCluster()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.cluster == nil {
+		w.cluster = &bytes.Buffer{}
+		w.clusterTimecode = timecode
+		ebmlWriteUint(w.cluster, EBML_ID_TIMECODE, uint64(timecode))
+	}
+
+	var flags byte = 0
+
+	if keyframe {
+		flags = 0x80
+	}
+
+	relativeTimecode := timecode - w.clusterTimecode
+
+	block := make([]byte, 4, 4+len(data))
+	block[0] = 0x81 // Track number 1
+	binary.BigEndian.PutUint16(block[1:3], uint16(int16(relativeTimecode)))
+	block[3] = flags
+	block = append(block, data...)
+
+	ebmlWriteElement(w.cluster, EBML_ID_SIMPLE_BLOCK, block)
+
+	if timecode > w.lastTimecode {
+		w.lastTimecode = timecode
+	}
+
+	return nil
+}
+
+// Closes the file, setting the segment size and the duration
+func (w *WebMWriter) close() error {
+	err := w.flushCluster()
+
+	if err == nil {
+		segmentSize := make([]byte, 8)
+		binary.BigEndian.PutUint64(segmentSize, uint64(w.size-w.segmentDataOffset))
+		segmentSize[0] = 0x01 // 8 bytes length marker
+
+		_, err = w.file.WriteAt(segmentSize, w.segmentDataOffset-8)
+	}
+
+	if err == nil {
+		duration := make([]byte, 8)
+		binary.BigEndian.PutUint64(duration, math.Float64bits(float64(w.lastTimecode)))
+
+		_, err = w.file.WriteAt(duration, w.durationOffset)
+	}
+
+	closeErr := w.file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Reads a variable length integer, returning the value and its length
+// If marker is false, the length marker is kept (element IDs)
+func ebmlReadVint(t *testing.T, data []byte, marker bool) (uint64, int) {
+	t.Helper()
+
+	if len(data) == 0 {
+		t.Fatal("unexpected end of data")
+	}
+
+	length := 1
+
+	for length <= 8 && data[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+
+	if length > 8 || len(data) < length {
+		t.Fatalf("invalid vint: %x", data[0])
+	}
+
+	value := uint64(data[0])
+
+	if !marker {
+		value &^= uint64(0x80 >> (length - 1))
+	}
+
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+	}
+
+	return value, length
+}
+
+// Reads the header of an element, returning the ID, the size and the header length
+func ebmlReadElementHeader(t *testing.T, data []byte) (uint32, uint64, int) {
+	t.Helper()
+
+	id, idLength := ebmlReadVint(t, data, true)
+	size, sizeLength := ebmlReadVint(t, data[idLength:], false)
+
+	return uint32(id), size, idLength + sizeLength
+}
+
+func TestEBMLWriteSize(t *testing.T) {
+	cases := []struct {
+		size   uint64
+		length int
+	}{
+		{0, 1},
+		{126, 1},
+		{127, 2}, // 0x7F is reserved (unknown size) in 1 byte
+		{16382, 2},
+		{16383, 3}, // 0x3FFF is reserved (unknown size) in 2 bytes
+		{2097150, 3},
+		{2097151, 4},
+		{1 << 40, 6},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		ebmlWriteSize(buf, c.size)
+
+		if buf.Len() != c.length {
+			t.Errorf("size %d: expected length %d, got %d (%x)", c.size, c.length, buf.Len(), buf.Bytes())
+			continue
+		}
+
+		value, length := ebmlReadVint(t, buf.Bytes(), false)
+
+		if length != c.length || value != c.size {
+			t.Errorf("size %d: read back %d (length %d)", c.size, value, length)
+		}
+	}
+}
+
+func TestWebMWriterClose(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.webm")
+
+	w, err := NewWebMWriter(fileName, false, 640, 480)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := bytes.Repeat([]byte{0xAB}, 200)
+
+	// 3 clusters: new keyframe, and max cluster duration
+	frames := []struct {
+		keyframe bool
+		timecode int64
+	}{
+		{true, 0},
+		{false, 40},
+		{false, 80},
+		{true, 1000},
+		{false, 1040},
+		{false, 1040 + WEBM_MAX_CLUSTER_DURATION},
+		{false, 1080 + WEBM_MAX_CLUSTER_DURATION},
+	}
+
+	for _, f := range frames {
+		err = w.writeFrame(frame, f.keyframe, f.timecode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectedDuration := w.getDuration()
+
+	if expectedDuration != 1080+WEBM_MAX_CLUSTER_DURATION {
+		t.Fatalf("unexpected duration: %d", expectedDuration)
+	}
+
+	err = w.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(data)) != w.size {
+		t.Fatalf("file size %d does not match written size %d", len(data), w.size)
+	}
+
+	// EBML header
+	id, size, headerLength := ebmlReadElementHeader(t, data)
+	if id != EBML_ID_HEADER {
+		t.Fatalf("expected EBML header, got %x", id)
+	}
+
+	offset := headerLength + int(size)
+
+	// Segment
+	id, size, headerLength = ebmlReadElementHeader(t, data[offset:])
+	if id != EBML_ID_SEGMENT {
+		t.Fatalf("expected segment, got %x", id)
+	}
+
+	segmentStart := offset + headerLength
+
+	if int64(segmentStart) != w.segmentDataOffset {
+		t.Fatalf("segment data offset %d, expected %d", w.segmentDataOffset, segmentStart)
+	}
+
+	if size != uint64(len(data)-segmentStart) {
+		t.Fatalf("segment size %d, expected %d", size, len(data)-segmentStart)
+	}
+
+	// Segment children
+	offset = segmentStart
+	clusters := 0
+	blocks := 0
+
+	for offset < len(data) {
+		id, size, headerLength = ebmlReadElementHeader(t, data[offset:])
+
+		if offset+headerLength+int(size) > len(data) {
+			t.Fatalf("element %x exceeds the file", id)
+		}
+
+		body := data[offset+headerLength : offset+headerLength+int(size)]
+
+		switch id {
+		case EBML_ID_INFO:
+			durationFound := false
+
+			for i := 0; i < len(body); {
+				childId, childSize, childHeaderLength := ebmlReadElementHeader(t, body[i:])
+
+				if childId == EBML_ID_DURATION {
+					durationFound = true
+
+					absoluteOffset := int64(offset + headerLength + i + childHeaderLength)
+					if absoluteOffset != w.durationOffset {
+						t.Fatalf("duration offset %d, expected %d", w.durationOffset, absoluteOffset)
+					}
+
+					duration := math.Float64frombits(binary.BigEndian.Uint64(body[i+childHeaderLength:]))
+					if duration != float64(expectedDuration) {
+						t.Fatalf("duration %f, expected %d", duration, expectedDuration)
+					}
+				}
+
+				i += childHeaderLength + int(childSize)
+			}
+
+			if !durationFound {
+				t.Fatal("duration not found")
+			}
+		case EBML_ID_CLUSTER:
+			clusters++
+
+			var clusterTimecode uint64
+
+			for i := 0; i < len(body); {
+				childId, childSize, childHeaderLength := ebmlReadElementHeader(t, body[i:])
+				child := body[i+childHeaderLength : i+childHeaderLength+int(childSize)]
+
+				switch childId {
+				case EBML_ID_TIMECODE:
+					for _, b := range child {
+						clusterTimecode = clusterTimecode<<8 | uint64(b)
+					}
+				case EBML_ID_SIMPLE_BLOCK:
+					f := frames[blocks]
+
+					relative := int16(binary.BigEndian.Uint16(child[1:3]))
+					if int64(clusterTimecode)+int64(relative) != f.timecode {
+						t.Fatalf("block %d: timecode %d, expected %d", blocks, int64(clusterTimecode)+int64(relative), f.timecode)
+					}
+
+					if (child[3]&0x80 != 0) != f.keyframe {
+						t.Fatalf("block %d: wrong keyframe flag", blocks)
+					}
+
+					blocks++
+				}
+
+				i += childHeaderLength + int(childSize)
+			}
+		}
+
+		offset += headerLength + int(size)
+	}
+
+	if clusters != 3 {
+		t.Fatalf("expected 3 clusters, got %d", clusters)
+	}
+
+	if blocks != len(frames) {
+		t.Fatalf("expected %d blocks, got %d", len(frames), blocks)
+	}
+}
@@ -0,0 +1,145 @@
+// Websocket client options
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default time to connect to a webrtc-cdn node
+const DEFAULT_WEBSOCKET_DIAL_TIMEOUT = 10 * time.Second
+
+// Default path of the websocket endpoint of the webrtc-cdn nodes
+const DEFAULT_WEBSOCKET_PATH = "/ws"
+
+// Websocket client options
+type WebsocketOptions struct {
+	caFile   string // CA bundle (PEM)
+	certFile string // Client certificate (PEM)
+	keyFile  string // Client certificate key (PEM)
+	insecure bool   // Skip TLS verification
+
+	proxy string // Proxy URL (http or socks5)
+
+	headers http.Header // Additional headers (Origin, Cookie, Authorization...)
+
+	path string // Path of the websocket endpoint
+
+	dialTimeout time.Duration
+
+	dialer *websocket.Dialer // Dialer, created by prepare()
+}
+
+// Creates new websocket options
+func NewWebsocketOptions() *WebsocketOptions {
+	return &WebsocketOptions{
+		headers:     make(http.Header),
+		path:        DEFAULT_WEBSOCKET_PATH,
+		dialTimeout: DEFAULT_WEBSOCKET_DIAL_TIMEOUT,
+	}
+}
+
+// Parses a header (Name: Value)
+func (o *WebsocketOptions) addHeader(raw string) error {
+	colonIndex := strings.Index(raw, ":")
+
+	if colonIndex <= 0 {
+		return errors.New("expected <name>: <value>")
+	}
+
+	o.headers.Add(strings.TrimSpace(raw[:colonIndex]), strings.TrimSpace(raw[colonIndex+1:]))
+
+	return nil
+}
+
+// Creates the dialer, loading the certificates
+func (o *WebsocketOptions) prepare() error {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: o.dialTimeout,
+	}
+
+	if o.proxy != "" {
+		proxyURL, err := url.Parse(o.proxy)
+		if err != nil {
+			return err
+		}
+
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+			return errors.New("the proxy must be an http:// or socks5:// URL")
+		}
+
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: o.insecure,
+	}
+
+	if o.caFile != "" {
+		caPEM, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return errors.New("no valid certificates found in " + o.caFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.certFile != "" || o.keyFile != "" {
+		if o.certFile == "" || o.keyFile == "" {
+			return errors.New("both the client certificate and its key are required")
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer.TLSClientConfig = tlsConfig
+
+	o.dialer = dialer
+
+	return nil
+}
+
+// Connects to a websocket URL
+// Failures are returned as signaling errors, including the HTTP status if the server responded.
+// Authentication failures (401, 403) are not retryable
+func (o *WebsocketOptions) dial(u string) (*websocket.Conn, error) {
+	conn, res, err := o.dialer.Dial(u, o.headers)
+
+	if err != nil {
+		message := "could not connect to " + u + ": " + err.Error()
+		retryable := true
+
+		if res != nil {
+			message += " (HTTP " + res.Status + ")"
+			retryable = res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden
+		}
+
+		return nil, &SignalingError{message: message, retryable: retryable}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,125 @@
+// WHEP playback
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Plays the source stream from a WHEP endpoint
+func runSourceSessionWHEP(session *SourceSession, startPublish func(), options ProcessOptions) {
+	defer close(session.ended)
+
+	api := createSourceAPI()
+
+	// Create peer connection
+	peerConnectionConfig := loadWebRTCConfig(WEBRTC_LEG_SOURCE) // Load config
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return
+	}
+	defer peerConnection.Close()
+
+	_, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return
+	}
+
+	authToken, err := options.auth.getToken(AUTH_ROLE_PLAY, session.source.streamId)
+	if err != nil {
+		session.onSignalingError(&SignalingError{message: "could not get the authentication token: " + err.Error(), retryable: true})
+		return
+	}
+
+	signaling := NewHTTPSignalingSession(session.source.url, authToken, "[SOURCE]", options.debug)
+	defer signaling.close()
+
+	removeShutdownHook := addShutdownHook(signaling.close)
+	defer removeShutdownHook()
+
+	// Ends the session
+	ended := make(chan struct{})
+	endedOnce := sync.Once{}
+	endSession := func() {
+		endedOnce.Do(func() {
+			close(ended)
+		})
+	}
+	session.setCloseFunc(endSession)
+
+	// Track listener
+	receivedVideoTrack := false
+	lock := sync.Mutex{}
+
+	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if receivedVideoTrack {
+			return // Already received the track
+		}
+
+		if remoteTrack.Kind() != webrtc.RTPCodecTypeVideo {
+			return // Not a video track
+		}
+
+		receivedVideoTrack = true
+
+		onSourceTrack(peerConnection, remoteTrack, session, startPublish, options)
+	})
+
+	// ICE Candidate handler
+	peerConnection.OnICECandidate(signaling.onLocalCandidate)
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			fmt.Println("[SOURCE] WebRTC: Disconnected")
+			endSession()
+		} else if state == webrtc.PeerConnectionStateConnected {
+			fmt.Println("[SOURCE] WebRTC: Connected")
+		}
+	})
+
+	// Generate offer
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return
+	}
+
+	err = peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return
+	}
+
+	// Send offer to the WHEP endpoint
+	if options.debug {
+		fmt.Println("Connecting to " + session.source.url.String())
+	}
+
+	answer, err := signaling.offer(offer.SDP)
+	if err != nil {
+		session.onSignalingError(fmt.Errorf("WHEP request failed: %w", err))
+		return
+	}
+
+	// Set remote description
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		fmt.Println("Error: " + err.Error())
+		return
+	}
+
+	<-ended
+}
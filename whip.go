@@ -0,0 +1,120 @@
+// WHIP publishing
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Publishes the track to a WHIP endpoint
+// Retries after retryable errors, like the webrtc-cdn destination
+func runPublishWHIP(videoTrack *webrtc.TrackLocalStaticRTP, destination StreamEndpoint, options PublishOptions) {
+	for {
+		err := runPublishSessionWHIP(videoTrack, destination, options)
+
+		fmt.Println("[DESTINATION] Error: " + err.Error())
+
+		var signalingErr *SignalingError
+
+		if !errors.As(err, &signalingErr) || !signalingErr.retryable {
+			exitProcess(1)
+		}
+
+		fmt.Println("[DESTINATION] Retrying in " + fmt.Sprint(PUBLISH_RETRY_DELAY) + "...")
+		time.Sleep(PUBLISH_RETRY_DELAY)
+	}
+}
+
+// Runs a WHIP publishing session
+// Returns when the connection fails
+func runPublishSessionWHIP(videoTrack *webrtc.TrackLocalStaticRTP, destination StreamEndpoint, options PublishOptions) error {
+	// Create peer connection
+	peerConnectionConfig := loadWebRTCConfig(WEBRTC_LEG_DESTINATION) // Load config
+	peerConnection, err := createWebRTCAPI(WEBRTC_LEG_DESTINATION).NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	// Add tracks
+	videoTransceiver, err := peerConnection.AddTransceiverFromTrack(videoTrack, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		return err
+	}
+
+	go readPacketsFromRTPSender(videoTransceiver.Sender())
+
+	// Get a fresh token for every session
+	authToken, err := options.auth.getToken(AUTH_ROLE_PUBLISH, destination.streamId)
+	if err != nil {
+		return &SignalingError{message: "could not get the authentication token: " + err.Error(), retryable: true}
+	}
+
+	session := NewHTTPSignalingSession(destination.url, authToken, "[DESTINATION]", options.debug)
+
+	removeShutdownHook := addShutdownHook(session.close)
+	defer func() {
+		removeShutdownHook()
+		session.close()
+	}()
+
+	// ICE Candidate handler
+	peerConnection.OnICECandidate(session.onLocalCandidate)
+
+	// Connection status handler
+	disconnected := make(chan struct{})
+	disconnectedOnce := sync.Once{}
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			fmt.Println("[DESTINATION] WebRTC: Disconnected")
+			disconnectedOnce.Do(func() {
+				close(disconnected)
+			})
+		} else if state == webrtc.PeerConnectionStateConnected {
+			fmt.Println("[DESTINATION] WebRTC: Connected")
+		}
+	})
+
+	// Generate offer
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	err = peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+
+	// Send offer to the WHIP endpoint
+	if options.debug {
+		fmt.Println("Connecting to " + destination.url.String())
+	}
+
+	answer, err := session.offer(offer.SDP)
+	if err != nil {
+		return fmt.Errorf("WHIP request failed: %w", err)
+	}
+
+	// Set remote description
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		// The endpoint sent an invalid answer, it may work with a new session
+		return &SignalingError{message: "invalid answer: " + err.Error(), retryable: true}
+	}
+
+	<-disconnected
+
+	return &SignalingError{message: "WebRTC connection lost", retryable: true}
+}
@@ -3,38 +3,199 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
 
+// WebRTC legs, used as prefix for the env variables specific to each leg
+const (
+	WEBRTC_LEG_SOURCE      = "SOURCE"
+	WEBRTC_LEG_DESTINATION = "DESTINATION"
+	WEBRTC_LEG_PREVIEW     = "PREVIEW"
+)
+
+// STUN server used if none is configured
+const DEFAULT_STUN_SERVER = "stun:stun.l.google.com:19302"
+
+// Default validity of the TURN credentials generated from a shared secret
+const DEFAULT_TURN_CREDENTIALS_TTL = 24 * time.Hour
+
+// Generates time-limited TURN credentials (TURN REST API)
+// The username is <expiry>:<user> and the password is base64(HMAC-SHA1(secret, username))
+func generateTURNCredentials(secret string, user string, ttl time.Duration) (string, string) {
+	username := fmt.Sprint(time.Now().Add(ttl).Unix())
+
+	if user != "" {
+		username += ":" + user
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Gets an env variable for a leg
+// The leg specific variable (SOURCE_NAME, DESTINATION_NAME) takes precedence over the global one (NAME)
+func getWebRTCEnv(leg string, name string) string {
+	if value := os.Getenv(leg + "_" + name); value != "" {
+		return value
+	}
+
+	return os.Getenv(name)
+}
+
+// Splits a comma separated list of URLs
+func splitURLList(list string) []string {
+	result := make([]string, 0)
+
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+
+		if u != "" {
+			result = append(result, u)
+		}
+	}
+
+	return result
+}
+
+// Checks if an env variable is set to a true value
+func isEnvTrue(value string) bool {
+	switch strings.ToUpper(value) {
+	case "YES", "TRUE", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// Parses the ICE servers (JSON) of a leg
+func parseICEServers(leg string) ([]webrtc.ICEServer, error) {
+	iceServers := make([]webrtc.ICEServer, 0)
+
+	iceServersJSON := getWebRTCEnv(leg, "ICE_SERVERS")
+	if iceServersJSON == "" {
+		return iceServers, nil
+	}
+
+	err := json.Unmarshal([]byte(iceServersJSON), &iceServers)
+	if err != nil {
+		return nil, errors.New("invalid ICE_SERVERS: " + err.Error())
+	}
+
+	return iceServers, nil
+}
+
+// Parses the ICE transport policy of a leg
+func parseICETransportPolicy(leg string) (webrtc.ICETransportPolicy, error) {
+	switch strings.ToLower(getWebRTCEnv(leg, "ICE_TRANSPORT_POLICY")) {
+	case "relay":
+		return webrtc.ICETransportPolicyRelay, nil
+	case "", "all":
+		return webrtc.ICETransportPolicyAll, nil
+	default:
+		return webrtc.ICETransportPolicyAll, errors.New("invalid ICE_TRANSPORT_POLICY. Expected 'all' or 'relay'")
+	}
+}
+
+// Parses the TTL of the generated TURN credentials of a leg
+func parseTURNCredentialsTTL(leg string) (time.Duration, error) {
+	value := getWebRTCEnv(leg, "TURN_CREDENTIALS_TTL")
+	if value == "" {
+		return DEFAULT_TURN_CREDENTIALS_TTL, nil
+	}
+
+	ttlSeconds, err := strconv.Atoi(value)
+	if err != nil || ttlSeconds <= 0 {
+		return DEFAULT_TURN_CREDENTIALS_TTL, errors.New("invalid TURN_CREDENTIALS_TTL: " + value)
+	}
+
+	return time.Duration(ttlSeconds) * time.Second, nil
+}
+
+// Validates the WebRTC config of all the legs
+// Called once at startup, so invalid values (e.g. a mistyped relay policy) are not silently ignored
+func validateWebRTCConfig() error {
+	for _, leg := range []string{WEBRTC_LEG_SOURCE, WEBRTC_LEG_DESTINATION, WEBRTC_LEG_PREVIEW} {
+		if _, err := parseICEServers(leg); err != nil {
+			return errors.New(leg + " leg: " + err.Error())
+		}
+
+		if _, err := parseICETransportPolicy(leg); err != nil {
+			return errors.New(leg + " leg: " + err.Error())
+		}
+
+		if _, err := parseTURNCredentialsTTL(leg); err != nil {
+			return errors.New(leg + " leg: " + err.Error())
+		}
+
+		if err := validateICENetworkSettings(leg); err != nil {
+			return errors.New(leg + " leg: " + err.Error())
+		}
+	}
+
+	return validateICEMuxSettings()
+}
+
 // This function loads WebRTC config from env variables
-func loadWebRTCConfig() webrtc.Configuration {
+// The values are validated at startup (validateWebRTCConfig)
+func loadWebRTCConfig(leg string) webrtc.Configuration {
 	peerConnectionConfig := webrtc.Configuration{
 		ICEServers: make([]webrtc.ICEServer, 0),
 	}
 
-	// STUN server
-	stunServer := os.Getenv("STUN_SERVER")
-	if stunServer != "" {
+	// ICE servers (JSON)
+	iceServersJSON := getWebRTCEnv(leg, "ICE_SERVERS")
+	iceServers, _ := parseICEServers(leg)
+	peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, iceServers...)
+
+	// STUN servers
+	stunServers := splitURLList(getWebRTCEnv(leg, "STUN_SERVER"))
+	if len(stunServers) > 0 {
 		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, webrtc.ICEServer{
-			URLs: []string{stunServer},
+			URLs: stunServers,
 		})
-	} else {
+	} else if iceServersJSON == "" && !isEnvTrue(getWebRTCEnv(leg, "DISABLE_DEFAULT_STUN")) {
 		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, webrtc.ICEServer{
-			URLs: []string{"stun:stun.l.google.com:19302"},
+			URLs: []string{DEFAULT_STUN_SERVER},
 		})
 	}
 
-	// TURN server
-	turnServer := os.Getenv("TURN_SERVER")
-	if turnServer != "" {
+	// TURN servers
+	// Example: turn:turn.example.com:3478,turn:turn.example.com:443?transport=tcp,turns:turn.example.com:5349
+	turnServers := splitURLList(getWebRTCEnv(leg, "TURN_SERVER"))
+	if len(turnServers) > 0 {
+		username := getWebRTCEnv(leg, "TURN_USERNAME")
+		password := getWebRTCEnv(leg, "TURN_PASSWORD")
+
+		// Shared secret, generate new credentials for each peer connection
+		turnSecret := getWebRTCEnv(leg, "TURN_SECRET")
+		if turnSecret != "" {
+			ttl, _ := parseTURNCredentialsTTL(leg)
+
+			username, password = generateTURNCredentials(turnSecret, username, ttl)
+		}
+
 		peerConnectionConfig.ICEServers = append(peerConnectionConfig.ICEServers, webrtc.ICEServer{
-			URLs:       []string{turnServer},
-			Username:   os.Getenv("TURN_USERNAME"),
-			Credential: os.Getenv("TURN_PASSWORD"),
+			URLs:       turnServers,
+			Username:   username,
+			Credential: password,
 		})
 	}
 
+	// Transport policy
+	peerConnectionConfig.ICETransportPolicy, _ = parseICETransportPolicy(leg)
+
 	return peerConnectionConfig
 }
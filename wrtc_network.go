@@ -0,0 +1,405 @@
+// WebRTC network settings
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// ICE muxes, shared by all the peer connections using the same port
+// Each port can be bound once, so the legs sharing a port must use the same filters
+var (
+	iceMuxLock  sync.Mutex
+	iceUDPMuxes = make(map[int]ice.UDPMux)
+	iceTCPMuxes = make(map[int]ice.TCPMux)
+
+	// Filters each mux was created with (interfaces and IPs)
+	iceMuxFilters = make(map[string]string)
+)
+
+// Gets the interfaces and IPs allowed for the ICE candidates of a leg
+func getICEFilters(leg string) ([]string, []string) {
+	return splitURLList(getWebRTCEnv(leg, "ICE_INTERFACES")), splitURLList(getWebRTCEnv(leg, "ICE_IPS"))
+}
+
+// Gets a string identifying the filters of a leg, to compare them
+func getICEFiltersKey(leg string) string {
+	interfaces, ips := getICEFilters(leg)
+	return "interfaces=" + strings.Join(interfaces, ",") + ";ips=" + strings.Join(ips, ",")
+}
+
+// Creates the interface filter for a list of interfaces
+func makeInterfaceFilter(interfaces []string) func(string) bool {
+	return func(name string) bool {
+		for _, i := range interfaces {
+			if i == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Creates the IP filter for a list of IPs
+func makeIPFilter(ips []string) func(net.IP) bool {
+	return func(ip net.IP) bool {
+		for _, i := range ips {
+			if ip.Equal(net.ParseIP(i)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Gets the local IPs allowed by the filters of a leg
+// Returns nil if there are no filters (all the IPs are allowed)
+func getICEListenIPs(leg string) ([]net.IP, error) {
+	interfaces, ips := getICEFilters(leg)
+
+	if len(interfaces) == 0 && len(ips) == 0 {
+		return nil, nil
+	}
+
+	interfaceFilter := makeInterfaceFilter(interfaces)
+	ipFilter := makeIPFilter(ips)
+
+	netInterfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]net.IP, 0)
+
+	for _, netInterface := range netInterfaces {
+		if len(interfaces) > 0 && !interfaceFilter(netInterface.Name) {
+			continue
+		}
+
+		addrs, err := netInterface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if len(ips) > 0 && !ipFilter(ipNet.IP) {
+				continue
+			}
+
+			result = append(result, ipNet.IP)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("no local IP matches ICE_INTERFACES / ICE_IPS")
+	}
+
+	return result, nil
+}
+
+// Gets the UDP mux for a port, creating it if needed
+func getICEUDPMux(leg string, port int) (ice.UDPMux, error) {
+	iceMuxLock.Lock()
+	defer iceMuxLock.Unlock()
+
+	filters := getICEFiltersKey(leg)
+
+	if mux := iceUDPMuxes[port]; mux != nil {
+		if iceMuxFilters["udp:"+fmt.Sprint(port)] != filters {
+			return nil, errors.New("ICE_UDP_MUX_PORT " + fmt.Sprint(port) + " is used by legs with different ICE_INTERFACES / ICE_IPS")
+		}
+		return mux, nil
+	}
+
+	interfaces, ips := getICEFilters(leg)
+
+	opts := make([]ice.UDPMuxFromPortOption, 0)
+
+	if len(interfaces) > 0 {
+		opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(makeInterfaceFilter(interfaces)))
+	}
+
+	if len(ips) > 0 {
+		opts = append(opts, ice.UDPMuxFromPortWithIPFilter(makeIPFilter(ips)))
+	}
+
+	mux, err := ice.NewMultiUDPMuxFromPort(port, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	iceUDPMuxes[port] = mux
+	iceMuxFilters["udp:"+fmt.Sprint(port)] = filters
+
+	return mux, nil
+}
+
+// Gets the TCP mux for a port, creating it if needed
+// The port is bound to the IPs allowed by the filters of the leg
+func getICETCPMux(leg string, port int) (ice.TCPMux, error) {
+	iceMuxLock.Lock()
+	defer iceMuxLock.Unlock()
+
+	filters := getICEFiltersKey(leg)
+
+	if mux := iceTCPMuxes[port]; mux != nil {
+		if iceMuxFilters["tcp:"+fmt.Sprint(port)] != filters {
+			return nil, errors.New("ICE_TCP_PORT " + fmt.Sprint(port) + " is used by legs with different ICE_INTERFACES / ICE_IPS")
+		}
+		return mux, nil
+	}
+
+	listenIPs, err := getICEListenIPs(leg)
+	if err != nil {
+		return nil, err
+	}
+
+	var mux ice.TCPMux
+
+	if listenIPs == nil {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{0, 0, 0, 0}, Port: port})
+		if err != nil {
+			return nil, err
+		}
+
+		mux = webrtc.NewICETCPMux(nil, listener, 8)
+	} else {
+		muxes := make([]ice.TCPMux, 0, len(listenIPs))
+
+		for _, ip := range listenIPs {
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+			if err != nil {
+				for _, m := range muxes {
+					m.Close()
+				}
+				return nil, err
+			}
+
+			muxes = append(muxes, webrtc.NewICETCPMux(nil, listener, 8))
+		}
+
+		mux = ice.NewMultiTCPMuxDefault(muxes...)
+	}
+
+	iceTCPMuxes[port] = mux
+	iceMuxFilters["tcp:"+fmt.Sprint(port)] = filters
+
+	return mux, nil
+}
+
+// Checks the legs sharing a mux port use the same filters
+func validateICEMuxSettings() error {
+	udpMuxLegs := make(map[int]string)
+	tcpMuxLegs := make(map[int]string)
+
+	for _, leg := range []string{WEBRTC_LEG_SOURCE, WEBRTC_LEG_DESTINATION, WEBRTC_LEG_PREVIEW} {
+		filters := getICEFiltersKey(leg)
+
+		if port, _ := parsePortEnv(leg, "ICE_UDP_MUX_PORT"); port > 0 {
+			if other, ok := udpMuxLegs[port]; ok && getICEFiltersKey(other) != filters {
+				return errors.New(other + " and " + leg + " legs use the same ICE_UDP_MUX_PORT (" + fmt.Sprint(port) + ") with different ICE_INTERFACES / ICE_IPS")
+			}
+			udpMuxLegs[port] = leg
+		}
+
+		if port, _ := parsePortEnv(leg, "ICE_TCP_PORT"); port > 0 {
+			if other, ok := tcpMuxLegs[port]; ok && getICEFiltersKey(other) != filters {
+				return errors.New(other + " and " + leg + " legs use the same ICE_TCP_PORT (" + fmt.Sprint(port) + ") with different ICE_INTERFACES / ICE_IPS")
+			}
+			tcpMuxLegs[port] = leg
+		}
+	}
+
+	return nil
+}
+
+// Parses a port from an env variable
+// Returns 0 if not set
+func parsePortEnv(leg string, name string) (int, error) {
+	value := getWebRTCEnv(leg, name)
+
+	if value == "" {
+		return 0, nil
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.New("invalid " + name + ": " + value)
+	}
+
+	return port, nil
+}
+
+// Parses the ephemeral UDP port range (ICE_UDP_PORT_MIN, ICE_UDP_PORT_MAX)
+// Returns 0, 0 if not set
+func parseICEUDPPortRange(leg string) (uint16, uint16, error) {
+	portMin, err := parsePortEnv(leg, "ICE_UDP_PORT_MIN")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	portMax, err := parsePortEnv(leg, "ICE_UDP_PORT_MAX")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if (portMin > 0) != (portMax > 0) {
+		return 0, 0, errors.New("ICE_UDP_PORT_MIN and ICE_UDP_PORT_MAX must be set together")
+	}
+
+	if portMin > portMax {
+		return 0, 0, errors.New("ICE_UDP_PORT_MIN is greater than ICE_UDP_PORT_MAX")
+	}
+
+	return uint16(portMin), uint16(portMax), nil
+}
+
+// Parses the mDNS mode (ICE_MDNS)
+func parseICEMulticastDNSMode(leg string) (ice.MulticastDNSMode, error) {
+	switch strings.ToLower(getWebRTCEnv(leg, "ICE_MDNS")) {
+	case "", "query":
+		return ice.MulticastDNSModeQueryOnly, nil
+	case "disabled":
+		return ice.MulticastDNSModeDisabled, nil
+	case "gather":
+		return ice.MulticastDNSModeQueryAndGather, nil
+	default:
+		return 0, errors.New("invalid ICE_MDNS. Expected 'disabled', 'query' or 'gather'")
+	}
+}
+
+// Validates the network settings of a leg
+func validateICENetworkSettings(leg string) error {
+	_, ips := getICEFilters(leg)
+
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return errors.New("invalid IP in ICE_IPS: " + ip)
+		}
+	}
+
+	if _, _, err := parseICEUDPPortRange(leg); err != nil {
+		return err
+	}
+
+	if _, err := parsePortEnv(leg, "ICE_UDP_MUX_PORT"); err != nil {
+		return err
+	}
+
+	if _, err := parsePortEnv(leg, "ICE_TCP_PORT"); err != nil {
+		return err
+	}
+
+	if _, err := parseICEMulticastDNSMode(leg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Creates the ICE muxes of all the legs
+// Called once at startup, after validateWebRTCConfig
+func createICEMuxes() error {
+	for _, leg := range []string{WEBRTC_LEG_SOURCE, WEBRTC_LEG_DESTINATION, WEBRTC_LEG_PREVIEW} {
+		if port, _ := parsePortEnv(leg, "ICE_UDP_MUX_PORT"); port > 0 {
+			if _, err := getICEUDPMux(leg, port); err != nil {
+				return errors.New(leg + " leg: could not create the UDP mux on port " + fmt.Sprint(port) + ": " + err.Error())
+			}
+		}
+
+		if port, _ := parsePortEnv(leg, "ICE_TCP_PORT"); port > 0 {
+			if _, err := getICETCPMux(leg, port); err != nil {
+				return errors.New(leg + " leg: could not create the TCP mux on port " + fmt.Sprint(port) + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Creates the setting engine for a leg, from env variables
+// The values are validated at startup (validateWebRTCConfig), and the muxes created (createICEMuxes)
+func createSettingEngine(leg string) webrtc.SettingEngine {
+	settingEngine := webrtc.SettingEngine{}
+
+	// Interfaces and IPs
+	interfaces, ips := getICEFilters(leg)
+
+	if len(interfaces) > 0 {
+		settingEngine.SetInterfaceFilter(makeInterfaceFilter(interfaces))
+	}
+
+	if len(ips) > 0 {
+		settingEngine.SetIPFilter(makeIPFilter(ips))
+	}
+
+	// Ephemeral UDP port range
+	if portMin, portMax, _ := parseICEUDPPortRange(leg); portMin > 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(portMin, portMax); err != nil {
+			panic(err)
+		}
+	}
+
+	// Single port UDP mux
+	if udpMuxPort, _ := parsePortEnv(leg, "ICE_UDP_MUX_PORT"); udpMuxPort > 0 {
+		mux, err := getICEUDPMux(leg, udpMuxPort)
+		if err != nil {
+			panic(err)
+		}
+
+		settingEngine.SetICEUDPMux(mux)
+	}
+
+	// NAT 1:1
+	nat1To1IPs := splitURLList(getWebRTCEnv(leg, "ICE_NAT_1TO1_IPS"))
+	if len(nat1To1IPs) > 0 {
+		settingEngine.SetNAT1To1IPs(nat1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	// ICE-TCP (passive candidates on a single port)
+	if tcpPort, _ := parsePortEnv(leg, "ICE_TCP_PORT"); tcpPort > 0 {
+		mux, err := getICETCPMux(leg, tcpPort)
+		if err != nil {
+			panic(err)
+		}
+
+		settingEngine.SetICETCPMux(mux)
+	}
+
+	// mDNS
+	mDNSMode, _ := parseICEMulticastDNSMode(leg)
+	settingEngine.SetICEMulticastDNSMode(mDNSMode)
+
+	return settingEngine
+}
+
+// Creates the WebRTC API for a leg, with the default codecs and interceptors
+func createWebRTCAPI(leg string) *webrtc.API {
+	m := &webrtc.MediaEngine{}
+
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		panic(err)
+	}
+
+	i := &interceptor.Registry{}
+
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		panic(err)
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(createSettingEngine(leg)))
+}